@@ -6,7 +6,10 @@ require (
 	github.com/stretchr/testify v1.6.1
 	github.com/xtaci/kcp-go/v5 v5.6.18
 	github.com/xtaci/lossyconn v0.0.0-20190602105132-8df528c0c9ae
+	github.com/xtaci/smux v1.5.56
 	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -18,7 +21,5 @@ require (
 	github.com/templexxx/cpu v0.1.1 // indirect
 	github.com/templexxx/xorsimd v0.4.3 // indirect
 	github.com/tjfoc/gmsm v1.4.1 // indirect
-	golang.org/x/net v0.35.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0 // indirect
 )
@@ -0,0 +1,363 @@
+package xkcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Authenticated encryption modes for KcpConfig.Crypt. Unlike the block
+// ciphers of GetBlockCrypt they seal every UDP datagram below KCP, so forged,
+// tampered and replayed packets are dropped before they reach a session.
+// Datagrams are stamped with the time: the clocks of both ends must be within
+// a minute of each other, and a datagram captured less than a minute ago can
+// still be replayed once to a receiver that restarted since.
+const (
+	CryptAESGCM           = "aes-gcm"
+	CryptChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+// Every sealed datagram is laid out as
+//
+//	sender id[8] | counter[8] | time[4] | ciphertext | tag[16]
+//
+// The sender id is picked at random by each endpoint and selects the packet
+// key derived from the shared key, the counter is the nonce under that key
+// and feeds the receiver's replay window. The time, in unix seconds, bounds
+// how long a datagram can be replayed once its sender is forgotten. The
+// header is authenticated as additional data.
+const (
+	aeadHeaderSize = 20
+	aeadTagSize    = 16
+	aeadOverhead   = aeadHeaderSize + aeadTagSize
+
+	// aeadBufferSize covers the largest KCP packet (1500 bytes) once sealed
+	aeadBufferSize = 2048
+
+	// aeadMaxPeers bounds the receive state kept for distinct senders
+	aeadMaxPeers = 4096
+
+	// aeadMaxAge is how far the time of a datagram may be from the clock of
+	// its receiver, which drops it otherwise
+	aeadMaxAge = time.Minute
+
+	// aeadPeerLifetime is how long the receive state of a quiet sender is
+	// kept at least. Once it is gone its datagrams are older than aeadMaxAge.
+	aeadPeerLifetime = 2*aeadMaxAge + time.Second
+
+	// replayWindowSize is how far behind the newest packet a counter may lag
+	replayWindowSize = 1024
+)
+
+var (
+	errAEADUnknownCrypt = errors.New("xkcp: not an aead crypt")
+	errInvalidOperation = errors.New("xkcp: invalid operation")
+)
+
+// isAEADCrypt reports whether crypt names an authenticated encryption mode
+func isAEADCrypt(crypt string) bool {
+	return crypt == CryptAESGCM || crypt == CryptChaCha20Poly1305
+}
+
+// newAEADCipher returns the AEAD for crypt keyed with a 32 byte key
+func newAEADCipher(crypt string, key []byte) (cipher.AEAD, error) {
+	switch crypt {
+	case CryptAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CryptChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, errAEADUnknownCrypt
+	}
+}
+
+// aeadConn seals every datagram written to the wrapped PacketConn and drops
+// every datagram read from it that fails authentication or is a replay
+type aeadConn struct {
+	socketOptions
+
+	crypt string
+	key   []byte
+
+	sender  [8]byte
+	seal    cipher.AEAD
+	counter uint64 // next send counter, guarded by sendMu
+	sendMu  sync.Mutex
+
+	mu    sync.Mutex
+	peers map[[8]byte]*aeadPeer
+
+	bufs sync.Pool
+}
+
+// aeadPeer is the receive state for one remote sender id
+type aeadPeer struct {
+	open     cipher.AEAD
+	window   replayWindow
+	lastSeen time.Time
+}
+
+// newAEADConn wraps conn with the authenticated encryption named by crypt
+func newAEADConn(conn net.PacketConn, crypt string, key []byte) (*aeadConn, error) {
+	c := &aeadConn{
+		socketOptions: socketOptions{conn},
+		crypt:         crypt,
+		key:           key,
+		peers:         make(map[[8]byte]*aeadPeer),
+		bufs:          newPacketPool(),
+	}
+
+	if _, err := rand.Read(c.sender[:]); err != nil {
+		return nil, err
+	}
+
+	seal, err := c.packetCipher(c.sender)
+	if err != nil {
+		return nil, err
+	}
+	c.seal = seal
+
+	return c, nil
+}
+
+// packetCipher derives the packet key used by sender
+func (c *aeadConn) packetCipher(sender [8]byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, c.key, sender[:], "xkcp packet key", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAEADCipher(c.crypt, key)
+}
+
+// WriteTo seals p and sends it to addr, it reports len(p) on success
+func (c *aeadConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	bp := c.bufs.Get().(*[]byte)
+	defer c.bufs.Put(bp)
+
+	buf := (*bp)[:0]
+	if cap(buf) < len(p)+aeadOverhead {
+		buf = make([]byte, 0, len(p)+aeadOverhead)
+	}
+	buf = c.sealPacket(buf, p, time.Now())
+
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// sealPacket appends the datagram sealing p at time now to dst
+func (c *aeadConn) sealPacket(dst, p []byte, now time.Time) []byte {
+	c.sendMu.Lock()
+	counter := c.counter
+	c.counter++
+	c.sendMu.Unlock()
+
+	start := len(dst)
+	dst = append(dst, c.sender[:]...)
+	dst = binary.BigEndian.AppendUint64(dst, counter)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(now.Unix()))
+	header := dst[start:]
+
+	var nonce [12]byte
+	copy(nonce[4:], header[8:16])
+	return c.seal.Seal(dst, nonce[:], p, header)
+}
+
+// ReadFrom returns the next authentic datagram, silently dropping the others
+func (c *aeadConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	bp := c.bufs.Get().(*[]byte)
+	defer c.bufs.Put(bp)
+	buf := *bp
+
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+
+		if plain, ok := c.open(buf[:n]); ok {
+			return copy(p, plain), addr, nil
+		}
+	}
+}
+
+// open authenticates and decrypts a sealed datagram in place
+func (c *aeadConn) open(pkt []byte) ([]byte, bool) {
+	if len(pkt) < aeadOverhead {
+		return nil, false
+	}
+
+	var sender [8]byte
+	copy(sender[:], pkt[:8])
+	counter := binary.BigEndian.Uint64(pkt[8:16])
+
+	now := time.Now()
+	if age := now.Sub(time.Unix(int64(binary.BigEndian.Uint32(pkt[16:aeadHeaderSize])), 0)); age > aeadMaxAge || age < -aeadMaxAge {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	peer, known := c.peers[sender]
+	if !known {
+		open, err := c.packetCipher(sender)
+		if err != nil {
+			return nil, false
+		}
+		peer = &aeadPeer{open: open}
+	}
+
+	if !peer.window.fresh(counter) {
+		return nil, false
+	}
+
+	var nonce [12]byte
+	copy(nonce[4:], pkt[8:16])
+	plain, err := peer.open.Open(pkt[aeadHeaderSize:aeadHeaderSize], nonce[:], pkt[aeadHeaderSize:], pkt[:aeadHeaderSize])
+	if err != nil {
+		return nil, false
+	}
+
+	// only authentic packets move the window or create receive state
+	peer.lastSeen = now
+	if !known && !c.addPeer(sender, peer, now) {
+		return nil, false
+	}
+	peer.window.mark(counter)
+
+	return plain, true
+}
+
+// addPeer stores the receive state of a new sender, evicting the least
+// recently seen one when full. It reports false when every sender was seen
+// within aeadPeerLifetime, the new one is then dropped: forgetting a sender
+// any sooner would let its recent datagrams be replayed. c.mu must be held.
+func (c *aeadConn) addPeer(sender [8]byte, peer *aeadPeer, now time.Time) bool {
+	if len(c.peers) >= aeadMaxPeers {
+		var oldest [8]byte
+		var oldestSeen time.Time
+		for id, p := range c.peers {
+			if oldestSeen.IsZero() || p.lastSeen.Before(oldestSeen) {
+				oldest, oldestSeen = id, p.lastSeen
+			}
+		}
+
+		if now.Sub(oldestSeen) < aeadPeerLifetime {
+			return false
+		}
+		delete(c.peers, oldest)
+	}
+
+	c.peers[sender] = peer
+	return true
+}
+
+// newPacketPool returns a pool of buffers large enough for any sealed datagram
+func newPacketPool() sync.Pool {
+	return sync.Pool{New: func() any {
+		b := make([]byte, aeadBufferSize)
+		return &b
+	}}
+}
+
+// socketOptions forwards the socket options kcp-go sets on its connection to
+// the wrapped PacketConn, so that they keep working through the wrappers
+type socketOptions struct {
+	net.PacketConn
+}
+
+// SetReadBuffer sets the read buffer of the wrapped socket
+func (c socketOptions) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errInvalidOperation
+}
+
+// SetWriteBuffer sets the write buffer of the wrapped socket
+func (c socketOptions) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errInvalidOperation
+}
+
+// SetDSCP sets the DSCP field of the wrapped socket, the same way kcp-go does for its own sockets
+func (c socketOptions) SetDSCP(dscp int) error {
+	if ts, ok := c.PacketConn.(interface{ SetDSCP(int) error }); ok {
+		return ts.SetDSCP(dscp)
+	}
+
+	if nc, ok := c.PacketConn.(net.Conn); ok {
+		var succeed bool
+		if err := ipv4.NewConn(nc).SetTOS(dscp << 2); err == nil {
+			succeed = true
+		}
+		if err := ipv6.NewConn(nc).SetTrafficClass(dscp); err == nil {
+			succeed = true
+		}
+
+		if succeed {
+			return nil
+		}
+	}
+	return errInvalidOperation
+}
+
+// replayWindow is a sliding bitmap of the counters received from one sender.
+// The bitmap has one word more than the window so that the word the newest
+// counter lives in never also holds counters that are still in the window.
+type replayWindow struct {
+	top    uint64
+	bitmap [replayWindowWords]uint64
+}
+
+const replayWindowWords = replayWindowSize/64 + 1
+
+// fresh reports whether counter is neither too old nor already received
+func (w *replayWindow) fresh(counter uint64) bool {
+	if counter > w.top {
+		return true
+	}
+
+	if w.top-counter >= replayWindowSize {
+		return false
+	}
+
+	bit := counter % (replayWindowWords * 64)
+	return w.bitmap[bit/64]&(1<<(bit%64)) == 0
+}
+
+// mark records counter as received, it must have passed fresh
+func (w *replayWindow) mark(counter uint64) {
+	if counter > w.top {
+		// clear the words the window slides over
+		cur, next := w.top/64, counter/64
+		for i := uint64(1); i <= next-cur && i <= replayWindowWords; i++ {
+			w.bitmap[(cur+i)%replayWindowWords] = 0
+		}
+		w.top = counter
+	}
+
+	bit := counter % (replayWindowWords * 64)
+	w.bitmap[bit/64] |= 1 << (bit % 64)
+}
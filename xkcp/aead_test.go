@@ -0,0 +1,257 @@
+package xkcp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testPacketPair returns two aead conns over loopback sockets keyed the same way
+func testPacketPair(t *testing.T, crypt string) (*aeadConn, *aeadConn) {
+	key := legacyKey("test seed")
+
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+
+	ca, err := newAEADConn(a, crypt, key)
+	require.NoError(t, err)
+
+	cb, err := newAEADConn(b, crypt, key)
+	require.NoError(t, err)
+
+	return ca, cb
+}
+
+func TestAEADConn_RoundTrip(t *testing.T) {
+	for _, crypt := range []string{CryptAESGCM, CryptChaCha20Poly1305} {
+		t.Run(crypt, func(t *testing.T) {
+			a, b := testPacketPair(t, crypt)
+
+			n, err := a.WriteTo([]byte("hello"), b.LocalAddr())
+			require.NoError(t, err)
+			require.Equal(t, 5, n)
+
+			buf := make([]byte, 1500)
+			b.SetReadDeadline(time.Now().Add(time.Second))
+			n, addr, err := b.ReadFrom(buf)
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(buf[:n]))
+			require.Equal(t, a.LocalAddr().String(), addr.String())
+		})
+	}
+}
+
+func TestAEADConn_DropsForged(t *testing.T) {
+	a, b := testPacketPair(t, CryptAESGCM)
+
+	// a peer with the wrong key
+	other, err := newAEADConn(a.PacketConn, CryptAESGCM, legacyKey("other seed"))
+	require.NoError(t, err)
+	_, err = other.WriteTo([]byte("forged"), b.LocalAddr())
+	require.NoError(t, err)
+
+	// raw garbage and a truncated packet
+	_, err = a.PacketConn.WriteTo(make([]byte, 64), b.LocalAddr())
+	require.NoError(t, err)
+	_, err = a.PacketConn.WriteTo([]byte("short"), b.LocalAddr())
+	require.NoError(t, err)
+
+	_, err = a.WriteTo([]byte("genuine"), b.LocalAddr())
+	require.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := b.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "genuine", string(buf[:n]))
+}
+
+func TestAEADConn_DropsTampered(t *testing.T) {
+	a, b := testPacketPair(t, CryptChaCha20Poly1305)
+
+	// capture a sealed packet on the raw socket
+	_, err := a.WriteTo([]byte("payload"), b.LocalAddr())
+	require.NoError(t, err)
+
+	raw := make([]byte, 1500)
+	b.PacketConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := b.PacketConn.ReadFrom(raw)
+	require.NoError(t, err)
+	sealed := raw[:n]
+
+	for _, i := range []int{0, 8, aeadHeaderSize, n - 1} {
+		tampered := append([]byte(nil), sealed...)
+		tampered[i] ^= 0xff
+		_, ok := b.open(tampered)
+		require.False(t, ok, "tampered byte %d accepted", i)
+	}
+
+	_, ok := b.open(append([]byte(nil), sealed...))
+	require.True(t, ok)
+}
+
+func TestAEADConn_DropsReplay(t *testing.T) {
+	a, b := testPacketPair(t, CryptAESGCM)
+
+	_, err := a.WriteTo([]byte("once"), b.LocalAddr())
+	require.NoError(t, err)
+
+	raw := make([]byte, 1500)
+	b.PacketConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := b.PacketConn.ReadFrom(raw)
+	require.NoError(t, err)
+
+	_, ok := b.open(append([]byte(nil), raw[:n]...))
+	require.True(t, ok)
+
+	_, ok = b.open(append([]byte(nil), raw[:n]...))
+	require.False(t, ok)
+}
+
+func TestAEADConn_DropsStale(t *testing.T) {
+	a, b := testPacketPair(t, CryptAESGCM)
+
+	for _, at := range []time.Duration{-2 * aeadMaxAge, 2 * aeadMaxAge} {
+		_, ok := b.open(a.sealPacket(nil, []byte("stale"), time.Now().Add(at)))
+		require.False(t, ok, "datagram sealed %v away accepted", at)
+	}
+
+	_, ok := b.open(a.sealPacket(nil, []byte("fresh"), time.Now()))
+	require.True(t, ok)
+}
+
+func TestAEADConn_KeepsRecentPeers(t *testing.T) {
+	a, b := testPacketPair(t, CryptAESGCM)
+
+	// every sender was heard from recently
+	now := time.Now()
+	for i := range aeadMaxPeers {
+		var sender [8]byte
+		binary.BigEndian.PutUint64(sender[:], uint64(i))
+		b.peers[sender] = &aeadPeer{lastSeen: now}
+	}
+
+	_, ok := b.open(a.sealPacket(nil, []byte("new sender"), now))
+	require.False(t, ok, "recent sender evicted")
+
+	// a sender quiet for long enough makes room
+	b.peers[[8]byte{}].lastSeen = now.Add(-aeadPeerLifetime)
+	_, ok = b.open(a.sealPacket(nil, []byte("new sender"), now))
+	require.True(t, ok)
+	require.Len(t, b.peers, aeadMaxPeers)
+	require.Contains(t, b.peers, a.sender)
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+
+	accept := func(counter uint64) bool {
+		if !w.fresh(counter) {
+			return false
+		}
+		w.mark(counter)
+		return true
+	}
+
+	require.True(t, accept(0))
+	require.False(t, accept(0))
+	require.True(t, accept(5))
+	require.True(t, accept(3), "reordered packet inside the window")
+	require.False(t, accept(3))
+
+	require.True(t, accept(replayWindowSize+10))
+	require.False(t, accept(5), "counter fell out of the window")
+	require.True(t, accept(replayWindowSize+9))
+	require.True(t, accept(11))
+	require.False(t, accept(10))
+
+	// a large jump clears the whole window
+	require.True(t, accept(100*replayWindowSize))
+	require.True(t, accept(100*replayWindowSize-1))
+	require.False(t, accept(100*replayWindowSize-replayWindowSize))
+
+	// the newest counter's word must not forget older counters still in the window
+	w = replayWindow{}
+	require.True(t, accept(63))
+	require.True(t, accept(replayWindowSize))
+	require.False(t, accept(63))
+}
+
+func TestAEADConfig_Echo(t *testing.T) {
+	for _, crypt := range []string{CryptAESGCM, CryptChaCha20Poly1305} {
+		t.Run(crypt, func(t *testing.T) {
+			conf := DefaultConfig()
+			conf.Handshake = true
+			conf.Crypt = crypt
+
+			saddr := getTestAddr()
+			server, err := NewServer(saddr, conf, &testEchoHandler{})
+			require.NoError(t, err)
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			client, err := DialContext(ctx, saddr, conf)
+			require.NoError(t, err)
+			defer client.Close()
+
+			testEcho(t, client)
+		})
+	}
+}
+
+func TestAEADConfig_WrongSeed(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Crypt = CryptAESGCM
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	clientConf := DefaultConfig()
+	clientConf.Crypt = CryptAESGCM
+	clientConf.Seed = "not the server seed"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	_, err = DialContext(ctx, saddr, clientConf)
+	require.Error(t, err)
+}
+
+func TestAEADConfig_WithConn(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.Crypt = CryptChaCha20Poly1305
+
+	sconn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+
+	server, err := NewServerWithConn(sconn, conf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	cconn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+	defer cconn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialContextWithConn(ctx, cconn, sconn.LocalAddr(), conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+}
@@ -0,0 +1,428 @@
+package xkcp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+)
+
+// Authentication methods reported in Identity.Method
+const (
+	AuthToken       = "token"
+	AuthEd25519     = "ed25519"
+	AuthCertificate = "certificate"
+)
+
+// method ids on the wire
+const (
+	authMethodToken       = 1
+	authMethodEd25519     = 2
+	authMethodCertificate = 3
+)
+
+// auth result status
+const (
+	authOK       = 0
+	authRejected = 1
+)
+
+const authNonceSize = 32
+
+var (
+	// ErrAuthFailed is returned when the client credential, or the server
+	// certificate for mutual authentication, is missing or invalid
+	ErrAuthFailed = errors.New("xkcp: authentication failed")
+
+	// ErrAuthRejected is returned by a dial when the server refused the client
+	ErrAuthRejected = errors.New("xkcp: server rejected the client")
+)
+
+// Identity is who a peer authenticated as
+type Identity struct {
+	Method string // AuthToken, AuthEd25519 or AuthCertificate
+	// Name is the key of the matching AuthConf.Tokens or AuthorizedKeys
+	// entry, or the subject common name of the certificate
+	Name string
+	// PublicKey is the Ed25519 key or the certificate key of the peer
+	PublicKey crypto.PublicKey
+	// Certificates is the verified certificate chain, leaf first
+	Certificates []*x509.Certificate
+}
+
+// Authorizer is implemented by handlers that decide which peers may open a
+// session. It runs once the client authenticated, id is nil when AuthConf
+// does not require authentication. Returning an error rejects the peer.
+type Authorizer interface {
+	Authorize(remote net.Addr, id *Identity) error
+}
+
+// Authenticated is implemented by the streams of authenticated sessions
+// handed to ServerStreamHandler and by the connections returned from
+// Listener.Accept when AuthConf requires authentication.
+type Authenticated interface {
+	Identity() *Identity
+}
+
+// authConn attaches the identity of its session to a connection
+type authConn struct {
+	net.Conn
+	id *Identity
+}
+
+func (c *authConn) Identity() *Identity {
+	return c.id
+}
+
+// clientAuth is the credential presented by a client
+type clientAuth struct {
+	method     byte
+	token      []byte
+	key        ed25519.PrivateKey
+	cert       *tls.Certificate
+	roots      *x509.CertPool // verifies the server proof, nil when not required
+	serverName string
+}
+
+// newClientAuth loads the client credential of conf, nil when there is none
+func newClientAuth(conf *AuthConf) (*clientAuth, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	a := &clientAuth{serverName: conf.ServerName}
+	switch {
+	case conf.Token != "":
+		a.method, a.token = authMethodToken, []byte(conf.Token)
+	case conf.PrivateKey != "":
+		seed, err := decodeKey(conf.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("xkcp: auth private key: %w", err)
+		}
+		a.method, a.key = authMethodEd25519, ed25519.NewKeyFromSeed(seed)
+	case conf.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.method, a.cert = authMethodCertificate, &cert
+	default:
+		return nil, nil
+	}
+
+	if conf.CAFile != "" {
+		roots, err := loadCertPool(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		a.roots = roots
+	}
+
+	return a, nil
+}
+
+// serverAuth is what a server accepts from clients
+type serverAuth struct {
+	tokens    map[string][]byte
+	keys      map[string]ed25519.PublicKey
+	clientCAs *x509.CertPool
+	cert      *tls.Certificate // proves the server to clients, may be nil
+}
+
+// newServerAuth loads the accepted credentials of conf, nil when the server
+// does not require authentication
+func newServerAuth(conf *AuthConf) (*serverAuth, error) {
+	if conf == nil || len(conf.Tokens) == 0 && len(conf.AuthorizedKeys) == 0 && conf.ClientCAFile == "" {
+		return nil, nil
+	}
+
+	a := &serverAuth{
+		tokens: make(map[string][]byte),
+		keys:   make(map[string]ed25519.PublicKey),
+	}
+
+	for name, token := range conf.Tokens {
+		a.tokens[name] = []byte(token)
+	}
+
+	for name, key := range conf.AuthorizedKeys {
+		pub, err := decodeKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("xkcp: authorized key %s: %w", name, err)
+		}
+		a.keys[name] = pub
+	}
+
+	if conf.ClientCAFile != "" {
+		pool, err := loadCertPool(conf.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		a.clientCAs = pool
+	}
+
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.cert = &cert
+	}
+
+	return a, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("xkcp: no certificates in %s", path)
+	}
+
+	return pool, nil
+}
+
+// authMessage is what a client proof covers, it binds the proof to the
+// session and to both nonces
+func authMessage(label string, conv uint32, serverNonce, clientNonce []byte, method byte) []byte {
+	msg := make([]byte, 0, len(label)+4+2*authNonceSize+1)
+	msg = append(msg, label...)
+	msg = binary.BigEndian.AppendUint32(msg, conv)
+	msg = append(msg, serverNonce...)
+	msg = append(msg, clientNonce...)
+	return append(msg, method)
+}
+
+// proof returns the auth frame payload: clientNonce | method | proof
+func (a *clientAuth) proof(conv uint32, serverNonce, clientNonce []byte) ([]byte, error) {
+	msg := authMessage("xkcp client auth", conv, serverNonce, clientNonce, a.method)
+
+	payload := append(slices.Clone(clientNonce), a.method)
+	switch a.method {
+	case authMethodToken:
+		mac := hmac.New(sha256.New, a.token)
+		mac.Write(msg)
+		return mac.Sum(payload), nil
+	case authMethodEd25519:
+		payload = append(payload, a.key.Public().(ed25519.PublicKey)...)
+		return append(payload, ed25519.Sign(a.key, msg)...), nil
+	default:
+		sig, err := signProof(a.cert.PrivateKey, msg)
+		if err != nil {
+			return nil, err
+		}
+		return appendCertProof(payload, a.cert.Certificate, sig), nil
+	}
+}
+
+// verify checks the server proof of an auth result, it returns the server
+// identity or nil when the client does not verify servers
+func (a *clientAuth) verify(conv uint32, serverNonce, clientNonce, proof []byte) (*Identity, error) {
+	if a.roots == nil {
+		return nil, nil
+	}
+
+	if len(proof) == 0 {
+		return nil, fmt.Errorf("%w: server presented no certificate", ErrAuthFailed)
+	}
+
+	chain, sig, err := parseCertProof(proof)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := authMessage("xkcp server auth", conv, serverNonce, clientNonce, authMethodCertificate)
+	return verifyCertProof(chain, sig, msg, x509.VerifyOptions{
+		Roots:     a.roots,
+		DNSName:   a.serverName,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+// verify checks the auth frame payload of a client and returns its identity
+func (a *serverAuth) verify(conv uint32, serverNonce, payload []byte) (id *Identity, clientNonce []byte, err error) {
+	if len(payload) < authNonceSize+1 {
+		return nil, nil, fmt.Errorf("%w: short auth frame", ErrAuthFailed)
+	}
+
+	clientNonce, method, proof := payload[:authNonceSize], payload[authNonceSize], payload[authNonceSize+1:]
+	msg := authMessage("xkcp client auth", conv, serverNonce, clientNonce, method)
+
+	switch method {
+	case authMethodToken:
+		// try every token, so that timing does not tell which one matched
+		var match string
+		for _, name := range slices.Sorted(maps.Keys(a.tokens)) {
+			mac := hmac.New(sha256.New, a.tokens[name])
+			mac.Write(msg)
+			if hmac.Equal(mac.Sum(nil), proof) && match == "" {
+				match = name
+			}
+		}
+
+		if match != "" {
+			return &Identity{Method: AuthToken, Name: match}, clientNonce, nil
+		}
+	case authMethodEd25519:
+		if len(proof) != ed25519.PublicKeySize+ed25519.SignatureSize {
+			break
+		}
+
+		pub := ed25519.PublicKey(proof[:ed25519.PublicKeySize])
+		for name, key := range a.keys {
+			if key.Equal(pub) && ed25519.Verify(key, msg, proof[ed25519.PublicKeySize:]) {
+				return &Identity{Method: AuthEd25519, Name: name, PublicKey: key}, clientNonce, nil
+			}
+		}
+	case authMethodCertificate:
+		if a.clientCAs == nil {
+			break
+		}
+
+		chain, sig, err := parseCertProof(proof)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		id, err := verifyCertProof(chain, sig, msg, x509.VerifyOptions{
+			Roots:     a.clientCAs,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		return id, clientNonce, err
+	}
+
+	return nil, nil, fmt.Errorf("%w: unknown credential", ErrAuthFailed)
+}
+
+// proof returns the server proof for an auth result, nil without a certificate
+func (a *serverAuth) proof(conv uint32, serverNonce, clientNonce []byte) ([]byte, error) {
+	if a.cert == nil {
+		return nil, nil
+	}
+
+	msg := authMessage("xkcp server auth", conv, serverNonce, clientNonce, authMethodCertificate)
+	sig, err := signProof(a.cert.PrivateKey, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendCertProof(nil, a.cert.Certificate, sig), nil
+}
+
+// signProof signs msg with a certificate key
+func signProof(key crypto.PrivateKey, msg []byte) ([]byte, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("xkcp: unsupported certificate key %T", key)
+	}
+
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(msg)
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// verifyCertProof verifies chain against opts and sig over msg with its leaf
+func verifyCertProof(chain [][]byte, sig, msg []byte, opts x509.VerifyOptions) (*Identity, error) {
+	certs := make([]*x509.Certificate, 0, len(chain))
+	for _, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%w: empty certificate chain", ErrAuthFailed)
+	}
+
+	opts.Intermediates = x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	leaf := certs[0]
+	if _, err := leaf.Verify(opts); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+
+	var algo x509.SignatureAlgorithm
+	switch leaf.PublicKey.(type) {
+	case ed25519.PublicKey:
+		algo = x509.PureEd25519
+	case *ecdsa.PublicKey:
+		algo = x509.ECDSAWithSHA256
+	case *rsa.PublicKey:
+		algo = x509.SHA256WithRSA
+	default:
+		return nil, fmt.Errorf("%w: unsupported certificate key %T", ErrAuthFailed, leaf.PublicKey)
+	}
+
+	if err := leaf.CheckSignature(algo, msg, sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+
+	return &Identity{Method: AuthCertificate, Name: leaf.Subject.CommonName, PublicKey: leaf.PublicKey, Certificates: certs}, nil
+}
+
+// appendCertProof encodes a certificate chain and a signature as
+// count[1] | (length[2] | der)... | signature
+func appendCertProof(dst []byte, chain [][]byte, sig []byte) []byte {
+	dst = append(dst, byte(len(chain)))
+	for _, der := range chain {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(der)))
+		dst = append(dst, der...)
+	}
+	return append(dst, sig...)
+}
+
+func parseCertProof(b []byte) (chain [][]byte, sig []byte, err error) {
+	if len(b) < 1 {
+		return nil, nil, fmt.Errorf("%w: malformed certificate proof", ErrAuthFailed)
+	}
+
+	n := int(b[0])
+	b = b[1:]
+	for i := 0; i < n; i++ {
+		if len(b) < 2 {
+			return nil, nil, fmt.Errorf("%w: malformed certificate proof", ErrAuthFailed)
+		}
+
+		size := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+size {
+			return nil, nil, fmt.Errorf("%w: malformed certificate proof", ErrAuthFailed)
+		}
+
+		chain = append(chain, b[2:2+size])
+		b = b[2+size:]
+	}
+
+	return chain, b, nil
+}
+
+// String returns the method and name of the identity, empty for nil
+func (id *Identity) String() string {
+	if id == nil {
+		return ""
+	}
+	return id.Method + ":" + id.Name
+}
@@ -0,0 +1,355 @@
+package xkcp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// testAuthHandler echoes sessions and streams and reports who opened them
+type testAuthHandler struct {
+	testEchoHandler
+
+	server atomic.Pointer[Server]
+	ids    chan *Identity
+	reject string // identity name refused by Authorize
+}
+
+func newTestAuthHandler() *testAuthHandler {
+	return &testAuthHandler{ids: make(chan *Identity, 16)}
+}
+
+func (h *testAuthHandler) Authorize(remote net.Addr, id *Identity) error {
+	if id != nil && id.Name == h.reject {
+		return errors.New("not allowed")
+	}
+	return nil
+}
+
+func (h *testAuthHandler) Handle(conn *kcp.UDPSession) {
+	h.ids <- h.server.Load().Identity(conn)
+	h.testEchoHandler.Handle(conn)
+}
+
+func (h *testAuthHandler) HandleStream(stream net.Conn) {
+	defer stream.Close()
+
+	if a, ok := stream.(Authenticated); ok {
+		h.ids <- a.Identity()
+	} else {
+		h.ids <- nil
+	}
+	io.Copy(stream, stream)
+}
+
+// testAuthServer starts a server requiring the authentication of conf
+func testAuthServer(t *testing.T, conf *KcpConfig, h *testAuthHandler) string {
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, h)
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	h.server.Store(server)
+	return saddr
+}
+
+// testAuthDial dials saddr and checks that the session echoes
+func testAuthDial(t *testing.T, saddr string, conf *KcpConfig) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialContext(ctx, saddr, conf)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { client.Close() })
+
+	testEcho(t, client)
+
+	return client, nil
+}
+
+func TestAuth_Token(t *testing.T) {
+	h := newTestAuthHandler()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.AuthConf = &AuthConf{Tokens: map[string]string{"alice": "alice-token", "bob": "bob-token"}}
+	saddr := testAuthServer(t, conf, h)
+
+	bob := DefaultConfig()
+	bob.Handshake = true
+	bob.AuthConf = &AuthConf{Token: "bob-token"}
+	_, err := testAuthDial(t, saddr, bob)
+	require.NoError(t, err)
+
+	id := <-h.ids
+	require.Equal(t, AuthToken, id.Method)
+	require.Equal(t, "bob", id.Name)
+
+	guess := DefaultConfig()
+	guess.Handshake = true
+	guess.AuthConf = &AuthConf{Token: "guess"}
+	_, err = testAuthDial(t, saddr, guess)
+	require.True(t, errors.Is(err, ErrAuthRejected), "unexpected error: %v", err)
+
+	anonymous := DefaultConfig()
+	anonymous.Handshake = true
+	_, err = testAuthDial(t, saddr, anonymous)
+	require.True(t, errors.Is(err, ErrAuthFailed), "unexpected error: %v", err)
+}
+
+func TestAuth_Ed25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, stranger, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	h := newTestAuthHandler()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.AuthConf = &AuthConf{AuthorizedKeys: map[string]string{"alice": hex.EncodeToString(pub)}}
+	saddr := testAuthServer(t, conf, h)
+
+	alice := DefaultConfig()
+	alice.Handshake = true
+	alice.AuthConf = &AuthConf{PrivateKey: hex.EncodeToString(priv.Seed())}
+	_, err = testAuthDial(t, saddr, alice)
+	require.NoError(t, err)
+
+	id := <-h.ids
+	require.Equal(t, AuthEd25519, id.Method)
+	require.Equal(t, "alice", id.Name)
+	require.True(t, pub.Equal(id.PublicKey))
+
+	other := DefaultConfig()
+	other.Handshake = true
+	other.AuthConf = &AuthConf{PrivateKey: hex.EncodeToString(stranger.Seed())}
+	_, err = testAuthDial(t, saddr, other)
+	require.True(t, errors.Is(err, ErrAuthRejected), "unexpected error: %v", err)
+}
+
+func TestAuth_Certificate(t *testing.T) {
+	pki := newTestPKI(t)
+	serverCert, serverKey := pki.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := pki.issue(t, "alice", x509.ExtKeyUsageClientAuth)
+
+	h := newTestAuthHandler()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.AuthConf = &AuthConf{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: pki.caFile}
+	saddr := testAuthServer(t, conf, h)
+
+	alice := DefaultConfig()
+	alice.Handshake = true
+	alice.AuthConf = &AuthConf{
+		CertFile:   clientCert,
+		KeyFile:    clientKey,
+		CAFile:     pki.caFile,
+		ServerName: "localhost",
+	}
+	client, err := testAuthDial(t, saddr, alice)
+	require.NoError(t, err)
+
+	id := <-h.ids
+	require.Equal(t, AuthCertificate, id.Method)
+	require.Equal(t, "alice", id.Name)
+	require.Len(t, id.Certificates, 1)
+	require.Equal(t, "server", client.ServerIdentity().Name)
+
+	// the server certificate is not valid for that name
+	wrongName := DefaultConfig()
+	wrongName.Handshake = true
+	wrongName.AuthConf = &AuthConf{
+		CertFile:   clientCert,
+		KeyFile:    clientKey,
+		CAFile:     pki.caFile,
+		ServerName: "example.com",
+	}
+	_, err = testAuthDial(t, saddr, wrongName)
+	require.True(t, errors.Is(err, ErrAuthFailed), "unexpected error: %v", err)
+
+	// a server certificate cannot be used by a client
+	asServer := DefaultConfig()
+	asServer.Handshake = true
+	asServer.AuthConf = &AuthConf{CertFile: serverCert, KeyFile: serverKey}
+	_, err = testAuthDial(t, saddr, asServer)
+	require.True(t, errors.Is(err, ErrAuthRejected), "unexpected error: %v", err)
+}
+
+func TestAuth_Authorizer(t *testing.T) {
+	h := newTestAuthHandler()
+	h.reject = "bob"
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.AuthConf = &AuthConf{Tokens: map[string]string{"alice": "alice-token", "bob": "bob-token"}}
+	saddr := testAuthServer(t, conf, h)
+
+	alice := DefaultConfig()
+	alice.Handshake = true
+	alice.AuthConf = &AuthConf{Token: "alice-token"}
+	_, err := testAuthDial(t, saddr, alice)
+	require.NoError(t, err)
+	require.Equal(t, "alice", (<-h.ids).Name)
+
+	bob := DefaultConfig()
+	bob.Handshake = true
+	bob.AuthConf = &AuthConf{Token: "bob-token"}
+	_, err = testAuthDial(t, saddr, bob)
+	require.True(t, errors.Is(err, ErrAuthRejected), "unexpected error: %v", err)
+}
+
+func TestAuth_NotRequired(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	h := newTestAuthHandler()
+	saddr := testAuthServer(t, conf, h)
+
+	// a credential the server does not ask for is not presented
+	alice := DefaultConfig()
+	alice.Handshake = true
+	alice.AuthConf = &AuthConf{Token: "alice-token"}
+	_, err := testAuthDial(t, saddr, alice)
+	require.NoError(t, err)
+	require.Nil(t, <-h.ids)
+}
+
+func TestAuth_Mux(t *testing.T) {
+	h := newTestAuthHandler()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.AuthConf = &AuthConf{Tokens: map[string]string{"alice": "alice-token"}}
+	conf.MuxConf = DefaultMuxConf()
+	saddr := testAuthServer(t, conf, h)
+
+	clientConf := DefaultConfig()
+	clientConf.Handshake = true
+	clientConf.AuthConf = &AuthConf{Token: "alice-token"}
+	clientConf.MuxConf = DefaultMuxConf()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialContext(ctx, saddr, clientConf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	stream, err := client.OpenStream()
+	require.NoError(t, err)
+	defer stream.Close()
+
+	testEcho(t, stream)
+
+	id := <-h.ids
+	require.NotNil(t, id)
+	require.Equal(t, "alice", id.Name)
+}
+
+func TestAuth_Listener(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.AuthConf = &AuthConf{Tokens: map[string]string{"alice": "alice-token"}}
+	lis, err := NewListener(getTestAddr(), conf)
+	require.NoError(t, err)
+	defer lis.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientConf := DefaultConfig()
+	clientConf.Handshake = true
+	clientConf.AuthConf = &AuthConf{Token: "alice-token"}
+	client, err := DialContext(ctx, lis.Addr().String(), clientConf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	conn, err := lis.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	a, ok := conn.(Authenticated)
+	require.True(t, ok, "accepted %T does not carry an identity", conn)
+	require.Equal(t, "alice", a.Identity().Name)
+}
+
+// testPKI is a throwaway certificate authority writing PEM files to a temp dir
+type testPKI struct {
+	dir    string
+	caFile string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "xkcp test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	p := &testPKI{dir: t.TempDir(), ca: ca, caKey: key, serial: 1}
+	p.caFile = p.write(t, "ca.pem", "CERTIFICATE", der)
+	return p
+}
+
+// issue returns the certificate and key files of a new leaf for name
+func (p *testPKI) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	p.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.ca, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return p.write(t, name+".pem", "CERTIFICATE", der), p.write(t, name+".key", "EC PRIVATE KEY", keyDER)
+}
+
+func (p *testPKI) write(t *testing.T, file, typ string, der []byte) string {
+	path := filepath.Join(p.dir, file)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600))
+	return path
+}
@@ -1,103 +1,417 @@
 package xkcp
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
 )
 
+// ErrMuxDisabled is returned by OpenStream when the client was created without MuxConf.
+var ErrMuxDisabled = errors.New("xkcp: stream multiplexing is not enabled")
+
+// Client is a KCP session to a Server. When MuxConf is set the session
+// carries smux frames and must only be used through OpenStream.
 type Client struct {
 	*kcp.UDPSession
+
+	mux     *smux.Session
+	server  *Identity
+	logger  *slog.Logger
+	metrics *Metrics
+	rates   *sessionRates
+	limited *rateConn // the session behind the rate limits
+	lent    *lentConn // the socket of the caller, nil when the client owns it
+
+	idle    atomic.Bool   // closed by the idle timeout
+	die     chan struct{} // closed by Close
+	dieOnce sync.Once
 }
 
 // NewClient creates a new xkcp client
 func NewClient(remoteAddr string, conf *KcpConfig) (*Client, error) {
-	// default UDP connection
-	kcpconn, err := kcp.DialWithOptions(remoteAddr, GetBlockCrypt(conf.Seed, conf.Crypt), conf.FECConf.DataShard, conf.FECConf.ParityShard)
+	return dial(context.Background(), remoteAddr, nil, false, WithConfig(conf))
+}
+
+// NewClientWithLocal creates a new xkcp client with local address
+func NewClientWithLocal(local, remote string, conf *KcpConfig) (*Client, error) {
+	return dial(context.Background(), remote, nil, false, WithConfig(conf), WithLocalAddr(local))
+}
+
+// NewClientWithConn creates a new xkcp client with a packet connection
+func NewClientWithConn(conn net.PacketConn, remoteAddr net.Addr, conf *KcpConfig) (*Client, error) {
+	return dial(context.Background(), "", remoteAddr, false, WithConfig(conf), WithPacketConn(conn), func(o *options) { o.ownConn = true })
+}
+
+// DialContext creates a new xkcp client and waits until the server has
+// answered the session handshake, ctx bounds how long it waits. It requires
+// KcpConfig.Handshake.
+func DialContext(ctx context.Context, remoteAddr string, conf *KcpConfig) (*Client, error) {
+	return dial(ctx, remoteAddr, nil, true, WithConfig(conf))
+}
+
+// DialContextWithLocal is like DialContext but binds the client to a local address
+func DialContextWithLocal(ctx context.Context, local, remote string, conf *KcpConfig) (*Client, error) {
+	return dial(ctx, remote, nil, true, WithConfig(conf), WithLocalAddr(local))
+}
+
+// DialContextWithConn is like DialContext but runs over an existing packet
+// connection. Unlike NewClientWithConn the client does not take ownership of
+// conn: it is left open when the dial fails and when the client is closed,
+// and the client stops reading it by then. Its read deadline is reset.
+func DialContextWithConn(ctx context.Context, conn net.PacketConn, remoteAddr net.Addr, conf *KcpConfig) (*Client, error) {
+	return dial(ctx, "", remoteAddr, true, WithConfig(conf), WithPacketConn(conn))
+}
+
+// Dial creates a new xkcp client to remote and waits until the server has
+// answered the session handshake, ctx bounds how long it waits. Without
+// WithPacketConn the client runs over a new UDP socket.
+func Dial(ctx context.Context, remote string, opts ...Option) (*Client, error) {
+	return dial(ctx, remote, nil, true, opts...)
+}
+
+// dial creates a client to remoteAddr, or to remote when remoteAddr is nil
+func dial(ctx context.Context, remote string, remoteAddr net.Addr, wait bool, opts ...Option) (*Client, error) {
+	o := newOptions(opts)
+	if err := o.conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	if wait && !o.conf.Handshake {
+		return nil, &ConfigError{Field: "Handshake", Reason: "must be set to wait for the server"}
+	}
+
+	if remoteAddr == nil {
+		udpaddr, err := net.ResolveUDPAddr("udp", remote)
+		if err != nil {
+			return nil, err
+		}
+		remoteAddr = udpaddr
+	}
+
+	var lent *lentConn
+	conn, ownConn := o.conn, o.ownConn
+	if conn == nil {
+		udpconn, err := listenUDP(o.localAddr, remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		conn, ownConn = udpconn, true
+	} else if !ownConn {
+		lent = &lentConn{socketOptions: socketOptions{conn}}
+		conn = lent
+	}
+
+	kcpconn, keepalive, err := newSession(ctx, conn, remoteAddr, o.conf, ownConn)
 	if err != nil {
+		if o.conn == nil {
+			conn.Close()
+		}
+		lent.release()
 		return nil, err
 	}
 
-	client, err := newClient(kcpconn, conf)
+	client, err := newClient(ctx, kcpconn, keepalive, o, wait)
 	if err != nil {
 		kcpconn.Close()
+		lent.release()
 		return nil, err
 	}
+	client.lent = lent
 
 	return client, nil
 }
 
-// NewClientWithLocal creates a new xkcp client with local address
-func NewClientWithLocal(local, remote string, conf *KcpConfig) (*Client, error) {
-	localAddr, err := net.ResolveUDPAddr("udp", local)
-	if err != nil {
-		return nil, err
+// lentConn is a socket of the caller that a client runs over. kcp-go keeps
+// reading a socket it does not own after its session is closed, release
+// stops those reads so that the caller gets its socket back.
+type lentConn struct {
+	socketOptions
+
+	mu       sync.Mutex
+	released bool
+	reading  sync.WaitGroup
+}
+
+// ReadFrom reads from the socket until it is released
+func (c *lentConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	if c.released {
+		c.mu.Unlock()
+		return 0, nil, net.ErrClosed
 	}
+	c.reading.Add(1)
+	c.mu.Unlock()
+	defer c.reading.Done()
 
-	remoteAddr, err := net.ResolveUDPAddr("udp", remote)
-	if err != nil {
-		return nil, err
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err != nil && c.isReleased() {
+		return 0, nil, net.ErrClosed
 	}
+	return n, addr, err
+}
 
-	localUdpConn, err := net.ListenUDP("udp", localAddr)
-	if err != nil {
-		return nil, err
+func (c *lentConn) isReleased() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.released
+}
+
+// release fails every later read and waits for the pending one, which an
+// expired read deadline interrupts. c may be nil.
+func (c *lentConn) release() {
+	if c == nil {
+		return
 	}
 
-	kcpconn, err := kcp.NewConn4(genConvid(), remoteAddr, GetBlockCrypt(conf.Seed, conf.Crypt), conf.FECConf.DataShard, conf.FECConf.ParityShard, true, localUdpConn)
-	if err != nil {
-		return nil, err
+	c.mu.Lock()
+	if c.released {
+		c.mu.Unlock()
+		return
 	}
+	c.released = true
+	c.mu.Unlock()
 
-	client, err := newClient(kcpconn, conf)
-	if err != nil {
-		kcpconn.Close()
-		return nil, err
+	_ = c.PacketConn.SetReadDeadline(time.Now())
+	c.reading.Wait()
+	_ = c.PacketConn.SetReadDeadline(time.Time{})
+}
+
+// listenUDP opens the socket of a client, bound to local when it is set
+func listenUDP(local string, remoteAddr net.Addr) (*net.UDPConn, error) {
+	if local != "" {
+		localAddr, err := net.ResolveUDPAddr("udp", local)
+		if err != nil {
+			return nil, err
+		}
+		return net.ListenUDP("udp", localAddr)
 	}
 
-	return client, nil
+	// default UDP connection, picked the same way as kcp.DialWithOptions
+	network := "udp4"
+	if udpaddr, ok := remoteAddr.(*net.UDPAddr); ok && udpaddr.IP.To4() == nil {
+		network = "udp"
+	}
+
+	return net.ListenUDP(network, nil)
 }
 
-// NewClientWithConn creates a new xkcp client with a packet connection
-func NewClientWithConn(conn net.PacketConn, remoteAddr net.Addr, conf *KcpConfig) (*Client, error) {
-	kcpconn, err := kcp.NewConn4(genConvid(), remoteAddr, GetBlockCrypt(conf.Seed, conf.Crypt), conf.FECConf.DataShard, conf.FECConf.ParityShard, true, conn)
+// newSession creates a kcp session to remoteAddr over conn, wrapped with the
+// packet encryption selected by conf and, when enabled, the keepalive layer
+// which is returned as well. With ownConn the session closes conn. The key
+// exchange, when enabled, runs here and is bounded by ctx.
+func newSession(ctx context.Context, conn net.PacketConn, remoteAddr net.Addr, conf *KcpConfig, ownConn bool) (*kcp.UDPSession, *keepaliveConn, error) {
+	key, block, err := packetCrypto(conf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	client, err := newClient(kcpconn, conf)
+	if conf.CookieConf != nil {
+		conn = newCookieClientConn(conn, remoteAddr)
+	}
+
+	wrapped, err := wrapDialConn(ctx, conn, remoteAddr, conf, key)
 	if err != nil {
-		kcpconn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	return client, nil
+	var keepalive *keepaliveConn
+	if keepaliveEnabled(conf) {
+		keepalive = newKeepaliveConn(wrapped)
+		keepalive.track(remoteAddr)
+		wrapped = keepalive
+	}
+
+	kcpconn, err := kcp.NewConn4(genConvid(), remoteAddr, block, conf.FECConf.DataShard, conf.FECConf.ParityShard, ownConn, wrapped)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return kcpconn, keepalive, nil
 }
 
-// newClient creates a new xkcp client
-func newClient(kcpconn *kcp.UDPSession, conf *KcpConfig) (*Client, error) {
+// newClient creates a new xkcp client and sends the session hello when
+// KcpConfig.Handshake is set. When wait is true, or a client credential is
+// configured, the hello must be acknowledged by the server before ctx is done.
+func newClient(ctx context.Context, kcpconn *kcp.UDPSession, keepalive *keepaliveConn, o *options, wait bool) (*Client, error) {
+	conf := o.conf
 	kcpconn.SetWriteDelay(false)
 	kcpconn.SetNoDelay(conf.ModeConf.NoDelay, conf.ModeConf.Interval, conf.ModeConf.Resend, conf.ModeConf.NoCongestion)
 	kcpconn.SetWindowSize(conf.SndWnd, conf.RcvWnd)
 	kcpconn.SetMtu(conf.MTU)
 	kcpconn.SetACKNoDelay(conf.AckNodelay)
 
+	logger := o.getLogger()
 	if conf.DSCP > 0 {
-		_ = kcpconn.SetDSCP(conf.DSCP)
+		warnOption(logger, "dscp", kcpconn.SetDSCP(conf.DSCP))
 	}
 
-	_ = kcpconn.SetReadBuffer(conf.SockBuf)
-	_ = kcpconn.SetWriteBuffer(conf.SockBuf)
+	warnOption(logger, "read buffer", kcpconn.SetReadBuffer(conf.SockBuf))
+	warnOption(logger, "write buffer", kcpconn.SetWriteBuffer(conf.SockBuf))
+
+	var accepted byte
+	var server *Identity
+	if conf.Handshake {
+		var flags byte
+		if conf.MuxConf != nil {
+			flags |= flagMux
+		}
+
+		auth, err := newClientAuth(conf.AuthConf)
+		if err != nil {
+			return nil, err
+		}
+
+		if auth != nil && !wait {
+			// authentication always waits for the server, bound it like a dial
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, handshakeTimeout)
+			defer cancel()
+		}
+
+		accepted, server, err = clientHandshake(ctx, kcpconn, flags, wait, auth)
+		if err != nil {
+			logger.Debug("xkcp: handshake failed", "remote", kcpconn.RemoteAddr(), "conv", kcpconn.GetConv(), "err", err)
+			return nil, err
+		}
+	}
 
 	client := &Client{
 		UDPSession: kcpconn,
+		server:     server,
+		logger:     logger,
+		metrics:    o.metrics,
+		rates:      newSessionRates(conf.RateConf),
+		die:        make(chan struct{}),
+	}
+	client.limited = newRateConn(kcpconn, client.rates, nil, client.die)
+
+	if conf.MuxConf != nil {
+		if accepted&flagMux == 0 {
+			logger.Debug("xkcp: handshake failed", "remote", kcpconn.RemoteAddr(), "conv", kcpconn.GetConv(), "err", ErrMuxRejected)
+			return nil, ErrMuxRejected
+		}
+
+		mux, err := smux.Client(client.limited, conf.MuxConf.smuxConfig())
+		if err != nil {
+			return nil, err
+		}
+		client.mux = mux
 	}
 
+	if keepalive != nil {
+		go client.keepaliveLoop(keepalive, conf)
+	}
+
+	o.metrics.dialed.Add(1)
+	o.metrics.addSession(kcpconn, RoleClient, server, client.rates)
+	logger.Debug("xkcp: session dialed", "remote", kcpconn.RemoteAddr(), "conv", kcpconn.GetConv(),
+		"mux", client.mux != nil, "server", server.String())
+
 	return client, nil
 }
 
+// OpenStream opens a new logical stream over the client session, each
+// stream is delivered to the server handler on its own.
+func (c *Client) OpenStream() (net.Conn, error) {
+	if c.mux == nil {
+		return nil, ErrMuxDisabled
+	}
+
+	stream, err := c.mux.OpenStream()
+	return stream, c.sessionErr(err)
+}
+
+// Read reads from the session, it fails with ErrIdleTimeout once the server
+// went quiet for IdleTimeout
+func (c *Client) Read(b []byte) (int, error) {
+	n, err := c.limited.Read(b)
+	return n, c.sessionErr(err)
+}
+
+// Write writes to the session, it fails with ErrIdleTimeout once the server
+// went quiet for IdleTimeout
+func (c *Client) Write(b []byte) (int, error) {
+	n, err := c.limited.Write(b)
+	return n, c.sessionErr(err)
+}
+
+// sessionErr replaces the error of an operation on a session closed by the
+// idle timeout with ErrIdleTimeout
+func (c *Client) sessionErr(err error) error {
+	if err != nil && c.idle.Load() {
+		return ErrIdleTimeout
+	}
+	return err
+}
+
+// keepaliveLoop probes the server when the client is quiet and closes the
+// client when the server is, until the client is closed
+func (c *Client) keepaliveLoop(keepalive *keepaliveConn, conf *KcpConfig) {
+	ticker := time.NewTicker(keepaliveTick(conf))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.die:
+			return
+		case <-ticker.C:
+		}
+
+		if keepalive.check(c.RemoteAddr(), keepalive.peer(c.RemoteAddr()), time.Duration(conf.KeepAlive)*time.Millisecond, time.Duration(conf.IdleTimeout)*time.Millisecond) {
+			c.logger.Info("xkcp: session idle, closing", "remote", c.RemoteAddr(), "conv", c.GetConv(), "err", ErrIdleTimeout)
+			c.metrics.idleTimeouts.Add(1)
+			c.idle.Store(true)
+			c.Close()
+			return
+		}
+	}
+}
+
+// ServerIdentity returns the identity proven by the server certificate, nil
+// unless AuthConf.CAFile is set
+func (c *Client) ServerIdentity() *Identity {
+	return c.server
+}
+
+// NumStreams returns the number of streams currently open on the client
+func (c *Client) NumStreams() int {
+	if c.mux == nil {
+		return 0
+	}
+
+	return c.mux.NumStreams()
+}
+
+// Stats returns the stats of the client session, the zero value once closed
+func (c *Client) Stats() SessionStats {
+	st, _ := c.metrics.sessionStats(c.UDPSession)
+	return st
+}
+
+// Close closes the client session along with all its streams
+func (c *Client) Close() error {
+	c.dieOnce.Do(func() { close(c.die) })
+	c.metrics.removeSession(c.UDPSession)
+	c.logger.Debug("xkcp: session closed", "remote", c.RemoteAddr(), "conv", c.GetConv())
+
+	defer c.lent.release()
+
+	if c.mux != nil {
+		return c.mux.Close()
+	}
+
+	return c.UDPSession.Close()
+}
+
 // genConvid generates a unique conversation id
 func genConvid() uint32 {
 	var convid uint32
@@ -1,10 +1,15 @@
 package xkcp
 
 import (
+	"context"
+	"errors"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/xtaci/kcp-go/v5"
 )
 
 func Test_genConvid(t *testing.T) {
@@ -70,3 +75,248 @@ func TestNewClientWithConn(t *testing.T) {
 		require.Equal(t, 5, n)
 	}
 }
+
+func TestNewClient_PlainKCPServer(t *testing.T) {
+	conf := DefaultConfig()
+
+	block, err := GetBlockCrypt(conf.Seed, conf.Crypt)
+	require.NoError(t, err)
+	lis, err := kcp.ListenWithOptions(getTestAddr(), block, conf.FECConf.DataShard, conf.FECConf.ParityShard)
+	require.NoError(t, err)
+	defer lis.Close()
+
+	client, err := NewClient(lis.Addr().String(), conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	sess, err := lis.AcceptKCP()
+	require.NoError(t, err)
+	defer sess.Close()
+
+	// a kcp-go server reads application data first
+	buf := make([]byte, 64)
+	sess.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := sess.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestDialContext_WithoutHandshake(t *testing.T) {
+	_, err := DialContext(context.Background(), getTestAddr(), DefaultConfig())
+	var ce *ConfigError
+	require.True(t, errors.As(err, &ce), "unexpected error: %v", err)
+	require.Equal(t, "Handshake", ce.Field)
+}
+
+func TestDialContext(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialContext(ctx, saddr, conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the hello-ack must not leak into application data
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestDialContext_DeadServer(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	client, err := DialContext(ctx, getTestAddr(), conf)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+	require.Nil(t, client)
+	require.True(t, time.Since(start) < 2*time.Second)
+}
+
+func TestDialContext_Cancel(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	client, err := DialContext(ctx, getTestAddr(), conf)
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error: %v", err)
+	require.Nil(t, client)
+}
+
+func TestDialContextWithLocal(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testSinkHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := DialContextWithLocal(context.Background(), getTestAddr(), saddr, conf)
+	require.NoError(t, err)
+	defer client.Close()
+}
+
+func TestDialContextWithLocal_ReleasesSocket(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	local := getTestAddr()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err := DialContextWithLocal(ctx, local, getTestAddr(), conf)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+
+	// the local socket opened by the dial must have been closed
+	conn, err := net.ListenPacket("udp", local)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestDialContextWithConn(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testSinkHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	conn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client, err := DialContextWithConn(context.Background(), conn, server.lis.Addr(), conf)
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	// the closed client no longer reads conn
+	testConnReads(t, conn)
+}
+
+// testConnReads checks that every datagram sent to conn reaches its reader
+func testConnReads(t *testing.T, conn net.PacketConn) {
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer sender.Close()
+
+	for i := 0; i < 100; i++ {
+		_, err := sender.WriteTo([]byte("ping"), conn.LocalAddr())
+		require.NoError(t, err)
+	}
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for i := 0; i < 100; i++ {
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err, "read %d of 100 datagrams", i)
+		require.Equal(t, "ping", string(buf[:n]))
+	}
+}
+
+func TestDialContextWithConn_KeepsConnOnFailure(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	conn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	raddr, err := net.ResolveUDPAddr("udp", getTestAddr())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err = DialContextWithConn(ctx, conn, raddr, conf)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+
+	// conn belongs to the caller and is still usable
+	_, err = conn.WriteTo([]byte("ping"), raddr)
+	require.NoError(t, err)
+	testConnReads(t, conn)
+}
+
+func TestClient_OpenStreamDisabled(t *testing.T) {
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, DefaultConfig(), &testSinkHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := NewClient(saddr, DefaultConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.OpenStream()
+	require.Equal(t, ErrMuxDisabled, err)
+	require.Zero(t, client.NumStreams())
+}
+
+func TestNewClient_InvalidConfig(t *testing.T) {
+	conf := DefaultConfig()
+	conf.FECConf = nil
+
+	// used to panic dereferencing FECConf
+	client, err := NewClient(getTestAddr(), conf)
+	require.Error(t, err)
+	require.Nil(t, client)
+
+	_, err = DialContext(context.Background(), getTestAddr(), nil)
+	require.Error(t, err)
+}
+
+func TestDialContext_KDF(t *testing.T) {
+	for name, modify := range map[string]func(c *KcpConfig){
+		"Argon2id": func(c *KcpConfig) {
+			c.KDFConf = &KDFConf{Algorithm: KDFArgon2id, Salt: "xkcp-test", Iterations: 1, Memory: 1024}
+		},
+		"RawKey": func(c *KcpConfig) { c.Seed, c.Key = "", strings.Repeat("0f", 32) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := DefaultConfig()
+			conf.Handshake = true
+			modify(conf)
+
+			saddr := getTestAddr()
+			server, err := NewServer(saddr, conf, &testEchoHandler{})
+			require.NoError(t, err)
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			client, err := DialContext(ctx, saddr, conf)
+			require.NoError(t, err)
+			defer client.Close()
+
+			// the legacy derivation of the same seed must not get through
+			ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+
+			_, err = DialContext(ctx, saddr, DefaultConfig())
+			require.Error(t, err)
+		})
+	}
+}
@@ -1,5 +1,16 @@
 package xkcp
 
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
 const (
 	ModeFast   = "fast"
 	ModeNormal = "normal"
@@ -8,28 +19,223 @@ const (
 )
 
 type KcpConfig struct {
-	Seed       string    `json:"seed"`
-	Crypt      string    `json:"crypt"`
-	MTU        int       `json:"mtu"`
-	SndWnd     int       `json:"sndwnd"`
-	RcvWnd     int       `json:"rcvwnd"`
-	DSCP       int       `json:"dscp"`
-	AckNodelay bool      `json:"acknodelay"`
-	SockBuf    int       `json:"sockbuf"`
-	ModeConf   *ModeConf `json:"mode"`
-	FECConf    *FECConf  `json:"fec"`
+	Seed       string    `json:"seed" yaml:"seed"`
+	Crypt      string    `json:"crypt" yaml:"crypt"`
+	MTU        int       `json:"mtu" yaml:"mtu"`
+	SndWnd     int       `json:"sndwnd" yaml:"sndwnd"`
+	RcvWnd     int       `json:"rcvwnd" yaml:"rcvwnd"`
+	DSCP       int       `json:"dscp" yaml:"dscp"`
+	AckNodelay bool      `json:"acknodelay" yaml:"acknodelay"`
+	SockBuf    int       `json:"sockbuf" yaml:"sockbuf"`
+	ModeConf   *ModeConf `json:"mode" yaml:"mode"`
+	FECConf    *FECConf  `json:"fec" yaml:"fec"`
+	MuxConf    *MuxConf  `json:"mux" yaml:"mux"`
+
+	// Handshake starts every session with the xkcp preamble. Both peers must
+	// set it. Without it sessions carry application data only, so that plain
+	// kcp-go peers can connect, and DialContext, Dial, MuxConf, AuthConf and
+	// LimitConf.Refuse are unavailable.
+	Handshake bool `json:"handshake" yaml:"handshake"`
+
+	// KeepAlive is how many milliseconds a session may go without sending
+	// before a probe is sent, so that the idle timeout of the peer does not
+	// fire. IdleTimeout is how many milliseconds a session may go without
+	// receiving anything, probes included, before it is closed. Zero disables
+	// either. They apply to the sessions of a Server and to a Client.
+	KeepAlive   int `json:"keepalive" yaml:"keepalive"`
+	IdleTimeout int `json:"idletimeout" yaml:"idletimeout"`
+
+	// Key is a raw 32 byte cipher key, hex or base64 encoded. When set it is
+	// used as is and Seed and KDFConf are ignored.
+	Key string `json:"key" yaml:"key"`
+	// KDFConf selects how the cipher key is derived from Seed, nil keeps the
+	// legacy PBKDF2-SHA1 derivation with a fixed salt.
+	KDFConf *KDFConf `json:"kdf" yaml:"kdf"`
+	// KeyExchangeConf enables the per-session key exchange, nil keeps one
+	// static key for every session.
+	KeyExchangeConf *KeyExchangeConf `json:"keyexchange" yaml:"keyexchange"`
+	// AuthConf enables client authentication, nil lets every peer that can
+	// encrypt for Seed in.
+	AuthConf *AuthConf `json:"auth" yaml:"auth"`
+	// LimitConf caps the sessions a Server admits, nil admits every session.
+	LimitConf *LimitConf `json:"limits" yaml:"limits"`
+	// CookieConf makes new peers prove their address before they get a
+	// session, nil hands every datagram to KCP.
+	CookieConf *CookieConf `json:"cookie" yaml:"cookie"`
+	// RateConf limits the bandwidth of sessions, nil leaves it to KCP.
+	RateConf *RateConf `json:"rate" yaml:"rate"`
+	// PoolConf runs the sessions of a Server on a fixed set of workers, nil
+	// runs every session in its own goroutine.
+	PoolConf *PoolConf `json:"pool" yaml:"pool"`
+
+	// Logger receives the events of the Server, Listener or Client created
+	// with this config, nil logs to slog.Default(). It is read once at
+	// creation, UpdateConfig keeps the logger the server started with.
+	Logger *slog.Logger `json:"-" yaml:"-"`
 }
 
 type FECConf struct {
-	DataShard   int `json:"datashard"`
-	ParityShard int `json:"parityshard"`
+	DataShard   int `json:"datashard" yaml:"datashard"`
+	ParityShard int `json:"parityshard" yaml:"parityshard"`
 }
 
 type ModeConf struct {
-	NoDelay      int `json:"nodelay"`
-	Interval     int `json:"interval"`
-	Resend       int `json:"resend"`
-	NoCongestion int `json:"nc"`
+	NoDelay      int `json:"nodelay" yaml:"nodelay"`
+	Interval     int `json:"interval" yaml:"interval"`
+	Resend       int `json:"resend" yaml:"resend"`
+	NoCongestion int `json:"nc" yaml:"nc"`
+}
+
+// MuxConf enables stream multiplexing over a single KCP session, a nil
+// MuxConf disables it. Both peers must enable it for it to be negotiated.
+type MuxConf struct {
+	Version           int `json:"version" yaml:"version"`                   // smux protocol version, 2 adds per-stream flow control
+	KeepAliveInterval int `json:"keepalive" yaml:"keepalive"`               // seconds between keepalive frames
+	KeepAliveTimeout  int `json:"keepalivetimeout" yaml:"keepalivetimeout"` // seconds without traffic before the session is closed
+	MaxFrameSize      int `json:"maxframesize" yaml:"maxframesize"`
+	MaxReceiveBuffer  int `json:"maxreceivebuffer" yaml:"maxreceivebuffer"` // receive buffer shared by all streams
+	MaxStreamBuffer   int `json:"maxstreambuffer" yaml:"maxstreambuffer"`   // per-stream flow control window
+}
+
+// Key derivation functions for KDFConf.Algorithm
+const (
+	KDFPBKDF2SHA1   = "pbkdf2-sha1"
+	KDFPBKDF2SHA256 = "pbkdf2-sha256"
+	KDFScrypt       = "scrypt"
+	KDFArgon2id     = "argon2id"
+	KDFHKDF         = "hkdf-sha256" // no work factor, only for high entropy seeds
+)
+
+// KDFConf configures the derivation of the cipher key from the seed, zero
+// cost fields take the defaults of the algorithm (see kdfDefaults). Both
+// peers must use the same settings.
+type KDFConf struct {
+	Algorithm   string `json:"algorithm" yaml:"algorithm"`
+	Salt        string `json:"salt" yaml:"salt"`               // defaults to "kcptransport", set a per-deployment salt
+	Iterations  int    `json:"iterations" yaml:"iterations"`   // PBKDF2 iterations, argon2id passes
+	Memory      int    `json:"memory" yaml:"memory"`           // argon2id memory in KiB
+	Cost        int    `json:"cost" yaml:"cost"`               // scrypt N, a power of two
+	BlockSize   int    `json:"blocksize" yaml:"blocksize"`     // scrypt r
+	Parallelism int    `json:"parallelism" yaml:"parallelism"` // scrypt p, argon2id threads
+}
+
+// KeyExchangeConf enables an X25519 key exchange at the start of every
+// session, so that each session is encrypted with its own keys and captured
+// traffic stays safe when the seed or static keys leak later on. It requires
+// one of the aead crypts. The exchange is authenticated by the key derived
+// from Seed (or Key) and, when PrivateKey is set, by static X25519 keys.
+type KeyExchangeConf struct {
+	// PrivateKey is the static X25519 private key of this peer, hex or base64
+	// encoded. Leave it empty to authenticate by the pre-shared key alone.
+	PrivateKey string `json:"privatekey" yaml:"privatekey"`
+	// PeerKeys are the accepted static public keys of the other side: the
+	// server key on a client, the allowed client keys on a server.
+	PeerKeys []string `json:"peerkeys" yaml:"peerkeys"`
+}
+
+// AuthConf configures the client authentication that runs in the session
+// preamble. A client presents the first credential set among Token,
+// PrivateKey and CertFile. A server requires every client to authenticate
+// as soon as one of Tokens, AuthorizedKeys or ClientCAFile is set. Ed25519
+// keys are hex or base64 encoded.
+type AuthConf struct {
+	Token      string `json:"token" yaml:"token"`           // client: pre-shared token
+	PrivateKey string `json:"privatekey" yaml:"privatekey"` // client: Ed25519 private key seed
+	CertFile   string `json:"certfile" yaml:"certfile"`     // PEM certificate chain of the client, or of the server for mutual authentication
+	KeyFile    string `json:"keyfile" yaml:"keyfile"`       // PEM private key of CertFile
+	CAFile     string `json:"cafile" yaml:"cafile"`         // client: PEM roots the server certificate must chain to
+	ServerName string `json:"servername" yaml:"servername"` // client: name the server certificate must be valid for
+
+	Tokens         map[string]string `json:"tokens" yaml:"tokens"`                 // server: accepted tokens by identity name
+	AuthorizedKeys map[string]string `json:"authorizedkeys" yaml:"authorizedkeys"` // server: accepted Ed25519 public keys by identity name
+	ClientCAFile   string            `json:"clientcafile" yaml:"clientcafile"`     // server: PEM roots client certificates must chain to
+}
+
+// LimitConf is the admission control of a Server, zero fields are unlimited.
+// Sessions over a limit are closed as soon as they are accepted, before
+// their handshake, and counted in Metrics by reject reason.
+type LimitConf struct {
+	MaxSessions      int `json:"maxsessions" yaml:"maxsessions"`           // concurrent sessions, handshakes included
+	MaxSessionsPerIP int `json:"maxsessionsperip" yaml:"maxsessionsperip"` // concurrent sessions from one source IP
+	MaxNewPerSecond  int `json:"maxnewpersecond" yaml:"maxnewpersecond"`   // new sessions per second, bursts of as many are allowed
+
+	// Refuse answers rejected sessions with a refusal that makes the dial
+	// of the client fail with ErrRefused, instead of dropping them silently.
+	// Clients that do not wait for the handshake read it as session data.
+	Refuse bool `json:"refuse" yaml:"refuse"`
+}
+
+// CookieConf enables the stateless cookie challenge that a listener sends to
+// peers without a session before KCP allocates one, so that floods from
+// spoofed addresses cost no memory. Both peers must set it, a client without
+// it cannot answer the challenge.
+type CookieConf struct {
+	Always    bool `json:"always" yaml:"always"`       // challenge every new peer, not only under load
+	Threshold int  `json:"threshold" yaml:"threshold"` // datagrams per second from new peers above which the listener is under load
+}
+
+// RateConf limits the bandwidth of sessions in bytes per second with token
+// buckets, zero rates are unlimited. Limits apply to the data read and
+// written by the application: a slow reader keeps the KCP receive window of
+// its session shut, which is what slows the peer down. A Server applies them
+// to multiplexed sessions and to the sessions its handler gets through
+// Server.Limited, a Client to all of its traffic.
+type RateConf struct {
+	SendRate       int `json:"sendrate" yaml:"sendrate"`             // per session
+	RecvRate       int `json:"recvrate" yaml:"recvrate"`             // per session
+	GlobalSendRate int `json:"globalsendrate" yaml:"globalsendrate"` // shared by the sessions of a Server
+	GlobalRecvRate int `json:"globalrecvrate" yaml:"globalrecvrate"` // shared by the sessions of a Server
+	Burst          int `json:"burst" yaml:"burst"`                   // bytes let through at once, defaults to a tenth of each rate
+}
+
+// What a Server does with a new session while every worker of its pool is
+// busy and the queue is full, see PoolConf.Full
+const (
+	PoolFullBlock     = "block"      // stop accepting until a worker is free
+	PoolFullReject    = "reject"     // reject the session with RejectPoolFull
+	PoolFullCloseIdle = "close_idle" // close the session that has been quiet the longest, then wait for its worker
+)
+
+// PoolConf is the worker pool of a Server. A worker runs a session from its
+// handshake until its handler returns, multiplexed sessions included, their
+// streams then run in goroutines of their own. Sessions accepted while every
+// worker is busy wait in a queue.
+type PoolConf struct {
+	Workers int    `json:"workers" yaml:"workers"` // sessions handled at once
+	Queue   int    `json:"queue" yaml:"queue"`     // sessions waiting for a worker
+	Full    string `json:"full" yaml:"full"`       // PoolFullBlock when empty
+}
+
+// logger returns the logger for events of objects created with c
+func (c *KcpConfig) logger() *slog.Logger {
+	if c != nil && c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// DefaultMuxConf returns the multiplexing settings used when enabling mux
+func DefaultMuxConf() *MuxConf {
+	return &MuxConf{
+		Version:           2,
+		KeepAliveInterval: 10,
+		KeepAliveTimeout:  30,
+		MaxFrameSize:      32768,
+		MaxReceiveBuffer:  4194304,
+		MaxStreamBuffer:   2097152,
+	}
+}
+
+// smuxConfig converts the mux settings to a smux configuration
+func (c *MuxConf) smuxConfig() *smux.Config {
+	return &smux.Config{
+		Version:           c.Version,
+		KeepAliveInterval: time.Duration(c.KeepAliveInterval) * time.Second,
+		KeepAliveTimeout:  time.Duration(c.KeepAliveTimeout) * time.Second,
+		MaxFrameSize:      c.MaxFrameSize,
+		MaxReceiveBuffer:  c.MaxReceiveBuffer,
+		MaxStreamBuffer:   c.MaxStreamBuffer,
+	}
 }
 
 func GetModeConf(mode string) *ModeConf {
@@ -61,3 +267,279 @@ func DefaultConfig() *KcpConfig {
 		FECConf:    &FECConf{DataShard: 10, ParityShard: 3},
 	}
 }
+
+// ConfigError describes an invalid KcpConfig field
+type ConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("xkcp: invalid config: %s %s", e.Field, e.Reason)
+}
+
+// Validate checks the configuration and reports every invalid field, the
+// returned error joins one *ConfigError per problem.
+func (c *KcpConfig) Validate() error {
+	if c == nil {
+		return &ConfigError{Field: "KcpConfig", Reason: "is nil"}
+	}
+
+	var errs []error
+	invalid := func(field, format string, args ...any) {
+		errs = append(errs, &ConfigError{Field: field, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	if !slices.Contains(supportedCrypts, c.Crypt) {
+		invalid("Crypt", "%q is not a supported cipher", c.Crypt)
+	} else if c.Seed == "" && c.Key == "" && c.Crypt != "null" && c.Crypt != "none" && !c.KeyExchangeConf.static() {
+		invalid("Seed", "must be set when Crypt is %q", c.Crypt)
+	}
+
+	if c.Key != "" {
+		if _, err := decodeKey(c.Key); err != nil {
+			invalid("Key", "%v", err)
+		}
+	}
+
+	if kx := c.KeyExchangeConf; kx != nil {
+		if !isAEADCrypt(c.Crypt) {
+			invalid("KeyExchangeConf", "requires Crypt %q or %q, got %q", CryptAESGCM, CryptChaCha20Poly1305, c.Crypt)
+		}
+
+		if kx.PrivateKey != "" {
+			if _, err := decodeKey(kx.PrivateKey); err != nil {
+				invalid("KeyExchangeConf.PrivateKey", "%v", err)
+			}
+		}
+
+		if (kx.PrivateKey == "") != (len(kx.PeerKeys) == 0) {
+			invalid("KeyExchangeConf.PeerKeys", "must be set together with PrivateKey")
+		}
+
+		for i, peer := range kx.PeerKeys {
+			if _, err := decodeKey(peer); err != nil {
+				invalid(fmt.Sprintf("KeyExchangeConf.PeerKeys[%d]", i), "%v", err)
+			}
+		}
+	}
+
+	if a := c.AuthConf; a != nil {
+		if a.PrivateKey != "" {
+			if _, err := decodeKey(a.PrivateKey); err != nil {
+				invalid("AuthConf.PrivateKey", "%v", err)
+			}
+		}
+
+		if (a.CertFile == "") != (a.KeyFile == "") {
+			invalid("AuthConf.KeyFile", "must be set together with CertFile")
+		}
+
+		if a.CAFile != "" && a.Token == "" && a.PrivateKey == "" && a.CertFile == "" {
+			invalid("AuthConf.CAFile", "requires a client credential")
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(a.Tokens)) {
+			if name == "" || a.Tokens[name] == "" {
+				invalid("AuthConf.Tokens", "must not have empty names or tokens")
+				break
+			}
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(a.AuthorizedKeys)) {
+			if _, err := decodeKey(a.AuthorizedKeys[name]); err != nil {
+				invalid(fmt.Sprintf("AuthConf.AuthorizedKeys[%s]", name), "%v", err)
+			}
+		}
+	}
+
+	if !c.Handshake {
+		if c.MuxConf != nil {
+			invalid("MuxConf", "requires Handshake")
+		}
+
+		if c.AuthConf != nil {
+			invalid("AuthConf", "requires Handshake")
+		}
+
+		if c.LimitConf != nil && c.LimitConf.Refuse {
+			invalid("LimitConf.Refuse", "requires Handshake")
+		}
+	}
+
+	if k := c.KDFConf; k != nil {
+		if !slices.Contains(supportedKDFs, k.Algorithm) {
+			invalid("KDFConf.Algorithm", "%q is not a supported key derivation function", k.Algorithm)
+		}
+
+		if k.Iterations < 0 {
+			invalid("KDFConf.Iterations", "must not be negative, got %d", k.Iterations)
+		}
+
+		if k.Memory < 0 {
+			invalid("KDFConf.Memory", "must not be negative, got %d", k.Memory)
+		}
+
+		if k.Cost < 0 || k.Cost == 1 || k.Cost&(k.Cost-1) != 0 {
+			invalid("KDFConf.Cost", "must be a power of two greater than 1, got %d", k.Cost)
+		}
+
+		if k.BlockSize < 0 {
+			invalid("KDFConf.BlockSize", "must not be negative, got %d", k.BlockSize)
+		}
+
+		// argon2 takes the thread count as a uint8
+		if k.Parallelism < 0 || k.Parallelism > 255 {
+			invalid("KDFConf.Parallelism", "must be between 0 and 255, got %d", k.Parallelism)
+		}
+	}
+
+	// kcp rejects an MTU below 50 bytes, kcp-go one above 1500
+	if c.MTU < 50 || c.MTU > 1500 {
+		invalid("MTU", "must be between 50 and 1500, got %d", c.MTU)
+	}
+
+	if c.SndWnd <= 0 {
+		invalid("SndWnd", "must be positive, got %d", c.SndWnd)
+	}
+
+	if c.RcvWnd <= 0 {
+		invalid("RcvWnd", "must be positive, got %d", c.RcvWnd)
+	}
+
+	if c.DSCP < 0 || c.DSCP > 63 {
+		invalid("DSCP", "must be between 0 and 63, got %d", c.DSCP)
+	}
+
+	if c.SockBuf <= 0 {
+		invalid("SockBuf", "must be positive, got %d", c.SockBuf)
+	}
+
+	if c.ModeConf == nil {
+		invalid("ModeConf", "is nil")
+	} else {
+		if c.ModeConf.NoDelay != 0 && c.ModeConf.NoDelay != 1 {
+			invalid("ModeConf.NoDelay", "must be 0 or 1, got %d", c.ModeConf.NoDelay)
+		}
+
+		if c.ModeConf.Interval <= 0 {
+			invalid("ModeConf.Interval", "must be positive, got %d", c.ModeConf.Interval)
+		}
+
+		if c.ModeConf.Resend < 0 {
+			invalid("ModeConf.Resend", "must not be negative, got %d", c.ModeConf.Resend)
+		}
+
+		if c.ModeConf.NoCongestion != 0 && c.ModeConf.NoCongestion != 1 {
+			invalid("ModeConf.NoCongestion", "must be 0 or 1, got %d", c.ModeConf.NoCongestion)
+		}
+	}
+
+	if c.FECConf == nil {
+		invalid("FECConf", "is nil")
+	} else {
+		if c.FECConf.DataShard < 0 {
+			invalid("FECConf.DataShard", "must not be negative, got %d", c.FECConf.DataShard)
+		}
+
+		if c.FECConf.ParityShard < 0 {
+			invalid("FECConf.ParityShard", "must not be negative, got %d", c.FECConf.ParityShard)
+		}
+
+		// reed-solomon works on at most 256 shards
+		if c.FECConf.DataShard+c.FECConf.ParityShard > 256 {
+			invalid("FECConf", "must not use more than 256 shards in total, got %d", c.FECConf.DataShard+c.FECConf.ParityShard)
+		}
+	}
+
+	if c.KeepAlive < 0 {
+		invalid("KeepAlive", "must not be negative, got %d", c.KeepAlive)
+	}
+
+	if c.IdleTimeout < 0 {
+		invalid("IdleTimeout", "must not be negative, got %d", c.IdleTimeout)
+	} else if c.IdleTimeout > 0 && c.IdleTimeout <= c.KeepAlive {
+		invalid("IdleTimeout", "must be longer than KeepAlive, got %d", c.IdleTimeout)
+	}
+
+	if l := c.LimitConf; l != nil {
+		if l.MaxSessions < 0 {
+			invalid("LimitConf.MaxSessions", "must not be negative, got %d", l.MaxSessions)
+		}
+
+		if l.MaxSessionsPerIP < 0 {
+			invalid("LimitConf.MaxSessionsPerIP", "must not be negative, got %d", l.MaxSessionsPerIP)
+		}
+
+		if l.MaxNewPerSecond < 0 {
+			invalid("LimitConf.MaxNewPerSecond", "must not be negative, got %d", l.MaxNewPerSecond)
+		}
+	}
+
+	if k := c.CookieConf; k != nil {
+		if k.Threshold < 0 || k.Threshold == 0 && !k.Always {
+			invalid("CookieConf.Threshold", "must be positive unless Always is set, got %d", k.Threshold)
+		}
+	}
+
+	if r := c.RateConf; r != nil {
+		for _, f := range []struct {
+			name string
+			rate int
+		}{
+			{"SendRate", r.SendRate},
+			{"RecvRate", r.RecvRate},
+			{"GlobalSendRate", r.GlobalSendRate},
+			{"GlobalRecvRate", r.GlobalRecvRate},
+			{"Burst", r.Burst},
+		} {
+			if f.rate < 0 {
+				invalid("RateConf."+f.name, "must not be negative, got %d", f.rate)
+			}
+		}
+	}
+
+	if p := c.PoolConf; p != nil {
+		if p.Workers <= 0 {
+			invalid("PoolConf.Workers", "must be positive, got %d", p.Workers)
+		}
+
+		if p.Queue < 0 {
+			invalid("PoolConf.Queue", "must not be negative, got %d", p.Queue)
+		}
+
+		switch p.Full {
+		case "", PoolFullBlock, PoolFullReject, PoolFullCloseIdle:
+		default:
+			invalid("PoolConf.Full", "must be %q, %q or %q, got %q", PoolFullBlock, PoolFullReject, PoolFullCloseIdle, p.Full)
+		}
+	}
+
+	if m := c.MuxConf; m != nil {
+		if m.Version != 1 && m.Version != 2 {
+			invalid("MuxConf.Version", "must be 1 or 2, got %d", m.Version)
+		}
+
+		if m.KeepAliveInterval <= 0 {
+			invalid("MuxConf.KeepAliveInterval", "must be positive, got %d", m.KeepAliveInterval)
+		}
+
+		if m.KeepAliveTimeout < m.KeepAliveInterval {
+			invalid("MuxConf.KeepAliveTimeout", "must not be shorter than KeepAliveInterval, got %d", m.KeepAliveTimeout)
+		}
+
+		if m.MaxFrameSize <= 0 || m.MaxFrameSize > 65535 {
+			invalid("MuxConf.MaxFrameSize", "must be between 1 and 65535, got %d", m.MaxFrameSize)
+		}
+
+		if m.MaxReceiveBuffer <= 0 {
+			invalid("MuxConf.MaxReceiveBuffer", "must be positive, got %d", m.MaxReceiveBuffer)
+		}
+
+		if m.MaxStreamBuffer <= 0 || m.MaxStreamBuffer > m.MaxReceiveBuffer {
+			invalid("MuxConf.MaxStreamBuffer", "must be positive and not larger than MaxReceiveBuffer, got %d", m.MaxStreamBuffer)
+		}
+	}
+
+	return errors.Join(errs...)
+}
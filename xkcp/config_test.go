@@ -1,10 +1,14 @@
 package xkcp
 
 import (
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/xtaci/smux"
 )
 
 func TestGetModeConf(t *testing.T) {
@@ -41,3 +45,123 @@ func TestDefaultConfig(t *testing.T) {
 	require.False(t, conf.AckNodelay)
 	require.Equal(t, GetModeConf(ModeNormal), conf.ModeConf)
 }
+
+func TestDefaultMuxConf(t *testing.T) {
+	conf := DefaultMuxConf()
+	require.NoError(t, smux.VerifyConfig(conf.smuxConfig()))
+	require.Equal(t, 2, conf.Version)
+	require.Equal(t, 10*time.Second, conf.smuxConfig().KeepAliveInterval)
+
+	require.Nil(t, DefaultConfig().MuxConf)
+}
+
+// configErrorFields returns the fields reported by a Validate error
+func configErrorFields(err error) []string {
+	var fields []string
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var ce *ConfigError
+		if errors.As(e, &ce) {
+			fields = append(fields, ce.Field)
+		}
+	}
+	return fields
+}
+
+func TestKcpConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *KcpConfig)
+		fields []string
+	}{
+		{name: "Default", modify: func(c *KcpConfig) {}},
+		{name: "NullCryptWithoutSeed", modify: func(c *KcpConfig) { c.Crypt, c.Seed = "null", "" }},
+		{name: "NoFEC", modify: func(c *KcpConfig) { c.FECConf = &FECConf{} }},
+		{name: "Mux", modify: func(c *KcpConfig) { c.Handshake, c.MuxConf = true, DefaultMuxConf() }},
+		{name: "UnknownCrypt", modify: func(c *KcpConfig) { c.Crypt = "rot13" }, fields: []string{"Crypt"}},
+		{name: "MissingSeed", modify: func(c *KcpConfig) { c.Seed = "" }, fields: []string{"Seed"}},
+		{name: "ZeroMTU", modify: func(c *KcpConfig) { c.MTU = 0 }, fields: []string{"MTU"}},
+		{name: "HugeMTU", modify: func(c *KcpConfig) { c.MTU = 9000 }, fields: []string{"MTU"}},
+		{name: "NegativeWindows", modify: func(c *KcpConfig) { c.SndWnd, c.RcvWnd = -1, 0 }, fields: []string{"SndWnd", "RcvWnd"}},
+		{name: "DSCP", modify: func(c *KcpConfig) { c.DSCP = 64 }, fields: []string{"DSCP"}},
+		{name: "SockBuf", modify: func(c *KcpConfig) { c.SockBuf = 0 }, fields: []string{"SockBuf"}},
+		{name: "NilModeConf", modify: func(c *KcpConfig) { c.ModeConf = nil }, fields: []string{"ModeConf"}},
+		{name: "BadModeConf", modify: func(c *KcpConfig) { c.ModeConf = &ModeConf{NoDelay: 2, Interval: 0, Resend: -1, NoCongestion: 3} },
+			fields: []string{"ModeConf.NoDelay", "ModeConf.Interval", "ModeConf.Resend", "ModeConf.NoCongestion"}},
+		{name: "NilFECConf", modify: func(c *KcpConfig) { c.FECConf = nil }, fields: []string{"FECConf"}},
+		{name: "BadFECConf", modify: func(c *KcpConfig) { c.FECConf = &FECConf{DataShard: -1, ParityShard: 300} },
+			fields: []string{"FECConf.DataShard", "FECConf"}},
+		{name: "BadMuxConf", modify: func(c *KcpConfig) {
+			c.Handshake, c.MuxConf = true, &MuxConf{Version: 3, KeepAliveInterval: 10, KeepAliveTimeout: 5}
+		},
+			fields: []string{"MuxConf.Version", "MuxConf.KeepAliveTimeout", "MuxConf.MaxFrameSize", "MuxConf.MaxReceiveBuffer", "MuxConf.MaxStreamBuffer"}},
+		{name: "RawKeyWithoutSeed", modify: func(c *KcpConfig) { c.Seed, c.Key = "", strings.Repeat("ab", 32) }},
+		{name: "KDF", modify: func(c *KcpConfig) { c.KDFConf = &KDFConf{Algorithm: KDFScrypt, Cost: 1024} }},
+		{name: "BadKey", modify: func(c *KcpConfig) { c.Key = "c2hvcnQ=" }, fields: []string{"Key"}},
+		{name: "BadKDFConf", modify: func(c *KcpConfig) {
+			c.KDFConf = &KDFConf{Algorithm: "md5", Iterations: -1, Cost: 1000, Parallelism: 256}
+		},
+			fields: []string{"KDFConf.Algorithm", "KDFConf.Iterations", "KDFConf.Cost", "KDFConf.Parallelism"}},
+		{name: "KeyExchange", modify: func(c *KcpConfig) { c.Crypt, c.KeyExchangeConf = CryptAESGCM, &KeyExchangeConf{} }},
+		{name: "KeyExchangeStaticWithoutSeed", modify: func(c *KcpConfig) {
+			c.Crypt, c.Seed = CryptChaCha20Poly1305, ""
+			c.KeyExchangeConf = &KeyExchangeConf{PrivateKey: strings.Repeat("01", 32), PeerKeys: []string{strings.Repeat("02", 32)}}
+		}},
+		{name: "BadKeyExchange", modify: func(c *KcpConfig) { c.KeyExchangeConf = &KeyExchangeConf{PeerKeys: []string{"key"}} },
+			fields: []string{"KeyExchangeConf", "KeyExchangeConf.PeerKeys", "KeyExchangeConf.PeerKeys[0]"}},
+		{name: "Auth", modify: func(c *KcpConfig) {
+			c.Handshake = true
+			c.AuthConf = &AuthConf{Token: "token", Tokens: map[string]string{"alice": "token"}, AuthorizedKeys: map[string]string{"bob": strings.Repeat("03", 32)}}
+		}},
+		{name: "BadAuthConf", modify: func(c *KcpConfig) {
+			c.Handshake = true
+			c.AuthConf = &AuthConf{PrivateKey: "key", CertFile: "cert.pem", Tokens: map[string]string{"": "token"}, AuthorizedKeys: map[string]string{"bob": "key"}}
+		}, fields: []string{"AuthConf.PrivateKey", "AuthConf.KeyFile", "AuthConf.Tokens", "AuthConf.AuthorizedKeys[bob]"}},
+		{name: "AuthCAWithoutCredential", modify: func(c *KcpConfig) { c.Handshake, c.AuthConf = true, &AuthConf{CAFile: "ca.pem"} }, fields: []string{"AuthConf.CAFile"}},
+		{name: "PreambleWithoutHandshake", modify: func(c *KcpConfig) {
+			c.MuxConf = DefaultMuxConf()
+			c.AuthConf = &AuthConf{Token: "token"}
+			c.LimitConf = &LimitConf{Refuse: true}
+		}, fields: []string{"MuxConf", "AuthConf", "LimitConf.Refuse"}},
+		{name: "Keepalive", modify: func(c *KcpConfig) { c.KeepAlive, c.IdleTimeout = 1000, 5000 }},
+		{name: "IdleTimeoutOnly", modify: func(c *KcpConfig) { c.IdleTimeout = 5000 }},
+		{name: "NegativeKeepalive", modify: func(c *KcpConfig) { c.KeepAlive, c.IdleTimeout = -1, -1 }, fields: []string{"KeepAlive", "IdleTimeout"}},
+		{name: "IdleTimeoutNotAfterKeepalive", modify: func(c *KcpConfig) { c.KeepAlive, c.IdleTimeout = 1000, 1000 }, fields: []string{"IdleTimeout"}},
+		{name: "Limits", modify: func(c *KcpConfig) {
+			c.LimitConf = &LimitConf{MaxSessions: 100, MaxSessionsPerIP: 10, MaxNewPerSecond: 50}
+		}},
+		{name: "NegativeLimits", modify: func(c *KcpConfig) {
+			c.LimitConf = &LimitConf{MaxSessions: -1, MaxSessionsPerIP: -1, MaxNewPerSecond: -1}
+		}, fields: []string{"LimitConf.MaxSessions", "LimitConf.MaxSessionsPerIP", "LimitConf.MaxNewPerSecond"}},
+		{name: "Cookie", modify: func(c *KcpConfig) { c.CookieConf = &CookieConf{Threshold: 100} }},
+		{name: "CookieAlways", modify: func(c *KcpConfig) { c.CookieConf = &CookieConf{Always: true} }},
+		{name: "CookieWithoutThreshold", modify: func(c *KcpConfig) { c.CookieConf = &CookieConf{} }, fields: []string{"CookieConf.Threshold"}},
+		{name: "Rate", modify: func(c *KcpConfig) { c.RateConf = &RateConf{SendRate: 1 << 20, GlobalRecvRate: 1 << 24} }},
+		{name: "NegativeRate", modify: func(c *KcpConfig) { c.RateConf = &RateConf{RecvRate: -1, Burst: -1} },
+			fields: []string{"RateConf.RecvRate", "RateConf.Burst"}},
+		{name: "Pool", modify: func(c *KcpConfig) { c.PoolConf = &PoolConf{Workers: 8, Queue: 16, Full: PoolFullCloseIdle} }},
+		{name: "InvalidPool", modify: func(c *KcpConfig) { c.PoolConf = &PoolConf{Queue: -1, Full: "drop"} },
+			fields: []string{"PoolConf.Workers", "PoolConf.Queue", "PoolConf.Full"}},
+		{name: "Everything", modify: func(c *KcpConfig) { *c = KcpConfig{Crypt: "aes"} },
+			fields: []string{"Seed", "MTU", "SndWnd", "RcvWnd", "SockBuf", "ModeConf", "FECConf"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := DefaultConfig()
+			tt.modify(conf)
+
+			err := conf.Validate()
+			if len(tt.fields) == 0 {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			require.Equal(t, tt.fields, configErrorFields(err))
+		})
+	}
+}
+
+func TestKcpConfig_ValidateNil(t *testing.T) {
+	var conf *KcpConfig
+	require.Error(t, conf.Validate())
+}
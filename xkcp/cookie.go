@@ -0,0 +1,274 @@
+package xkcp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// kcp-go allocates a session for the first datagram of every new
+// conversation. With CookieConf a listener checks that new peers can receive
+// at their source address first, the way DTLS HelloVerifyRequest does:
+//
+//	client -> server: datagram                            (dropped)
+//	server -> client: magic[7] | cookie[16]
+//	client -> server: magic[7] | cookie[16] | datagram    (until the server answers)
+//
+// The cookie is a MAC of the client address and of the current
+// cookieLifetime period, so the server keeps no state for the peers it
+// challenges and spoofed sources never learn their cookie. A challenge is
+// shorter than the datagram it answers and cannot be used for amplification.
+const (
+	cookieMagic      = "xkcp-ck"
+	cookieSize       = 16
+	cookieHeaderSize = len(cookieMagic) + cookieSize
+	cookieLifetime   = 2 * time.Minute
+
+	// kcpMinPacket is the size of the smallest datagram kcp-go sends
+	kcpMinPacket = 24
+)
+
+// cookieConn sits right above the socket of a listener. It hands datagrams
+// of known peers to the layers above and, when cookies are required,
+// challenges the others.
+type cookieConn struct {
+	socketOptions
+
+	conf    CookieConf
+	secret  []byte
+	logger  *slog.Logger
+	metrics *Metrics
+
+	mu        sync.Mutex
+	known     map[string]time.Time // when peers were last heard from
+	second    int64                // unix second count is for
+	count     int                  // datagrams from unknown peers during second
+	prevCount int                  // the same for the second before
+	loaded    bool
+	lastSweep time.Time
+}
+
+func newCookieConn(conn net.PacketConn, conf *CookieConf, logger *slog.Logger, metrics *Metrics) (*cookieConn, error) {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &cookieConn{
+		socketOptions: socketOptions{conn},
+		conf:          *conf,
+		secret:        secret,
+		logger:        logger,
+		metrics:       metrics,
+		known:         make(map[string]time.Time),
+		lastSweep:     time.Now(),
+	}, nil
+}
+
+// cookie returns the cookie of addr for the period epoch
+func (c *cookieConn) cookie(addr net.Addr, epoch int64) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	_ = binary.Write(mac, binary.BigEndian, epoch)
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:cookieSize]
+}
+
+// valid reports whether cookie was handed to addr during the current or the
+// previous period
+func (c *cookieConn) valid(cookie []byte, addr net.Addr, now time.Time) bool {
+	epoch := now.Unix() / int64(cookieLifetime/time.Second)
+	return hmac.Equal(cookie, c.cookie(addr, epoch)) || hmac.Equal(cookie, c.cookie(addr, epoch-1))
+}
+
+// challenge sends the current cookie of addr to it
+func (c *cookieConn) challenge(addr net.Addr, now time.Time) {
+	epoch := now.Unix() / int64(cookieLifetime/time.Second)
+	msg := append([]byte(cookieMagic), c.cookie(addr, epoch)...)
+
+	// best effort, the peer retransmits
+	_, _ = c.PacketConn.WriteTo(msg, addr)
+	c.metrics.cookieChallenges.Add(1)
+}
+
+// ReadFrom returns the next datagram from a known peer, or with a valid
+// cookie which is stripped
+func (c *cookieConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		if n, ok := c.admit(p[:n], addr); ok {
+			return n, addr, nil
+		}
+	}
+}
+
+// admit returns the size of the datagram in p once its cookie is removed,
+// or false when it is dropped
+func (c *cookieConn) admit(p []byte, addr net.Addr) (int, bool) {
+	now := time.Now()
+
+	if len(p) > cookieHeaderSize && string(p[:len(cookieMagic)]) == cookieMagic {
+		if !c.valid(p[len(cookieMagic):cookieHeaderSize], addr, now) {
+			c.challenge(addr, now)
+			return 0, false
+		}
+
+		c.mu.Lock()
+		c.known[addr.String()] = now
+		c.mu.Unlock()
+		return copy(p, p[cookieHeaderSize:]), true
+	}
+
+	c.mu.Lock()
+	seen, known := c.known[addr.String()]
+	known = known && now.Sub(seen) < cookieLifetime
+	if known || !c.conf.Always && !c.underLoad(now) {
+		c.known[addr.String()] = now
+		known = true
+	}
+	c.mu.Unlock()
+
+	if known {
+		return len(p), true
+	}
+
+	// anything shorter is not KCP and not worth an answer
+	if len(p) >= kcpMinPacket {
+		c.challenge(addr, now)
+	}
+	return 0, false
+}
+
+// underLoad counts a datagram from an unknown peer and reports whether
+// their rate is over the threshold, during this second or the previous one.
+// Known peers are swept from time to time. c.mu must be held.
+func (c *cookieConn) underLoad(now time.Time) bool {
+	if second := now.Unix(); second != c.second {
+		c.prevCount = 0
+		if second == c.second+1 {
+			c.prevCount = c.count
+		}
+		c.second, c.count = second, 0
+
+		if now.Sub(c.lastSweep) >= cookieLifetime/2 {
+			c.sweep(now)
+		}
+	}
+
+	c.count++
+	loaded := c.count > c.conf.Threshold || c.prevCount > c.conf.Threshold
+
+	if loaded != c.loaded {
+		c.loaded = loaded
+		if loaded {
+			c.logger.Warn("xkcp: under load, requiring cookies", "addr", c.LocalAddr(), "threshold", c.conf.Threshold)
+		} else {
+			c.logger.Info("xkcp: load over, cookies no longer required", "addr", c.LocalAddr())
+		}
+	}
+
+	return loaded
+}
+
+// sweep forgets the peers that have been quiet for cookieLifetime, c.mu must be held
+func (c *cookieConn) sweep(now time.Time) {
+	for addr, seen := range c.known {
+		if now.Sub(seen) >= cookieLifetime {
+			delete(c.known, addr)
+		}
+	}
+	c.lastSweep = now
+}
+
+// forget makes addr an unknown peer again, once its session is gone
+func (c *cookieConn) forget(addr net.Addr) {
+	c.mu.Lock()
+	delete(c.known, addr.String())
+	c.mu.Unlock()
+}
+
+// cookieClientConn sits right above the socket of a client. It answers the
+// cookie challenges of the server and attaches the cookie to every datagram
+// until the server answers one.
+type cookieClientConn struct {
+	socketOptions
+
+	remote   string
+	answered atomic.Bool
+
+	mu     sync.Mutex
+	cookie []byte
+	last   []byte // last datagram sent before the server answered
+}
+
+func newCookieClientConn(conn net.PacketConn, remote net.Addr) *cookieClientConn {
+	return &cookieClientConn{socketOptions: socketOptions{conn}, remote: remote.String()}
+}
+
+// WriteTo sends p to addr, behind the cookie if the server asked for one
+func (c *cookieClientConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.answered.Load() {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+
+	c.mu.Lock()
+	cookie := c.cookie
+	c.last = append(c.last[:0], p...)
+	c.mu.Unlock()
+
+	if cookie == nil {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+
+	msg := make([]byte, 0, cookieHeaderSize+len(p))
+	msg = append(msg, cookieMagic...)
+	msg = append(msg, cookie...)
+	if _, err := c.PacketConn.WriteTo(append(msg, p...), addr); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// ReadFrom returns the next datagram that is not a challenge, a challenge
+// resends the last datagram with its cookie
+func (c *cookieClientConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		if n == cookieHeaderSize && string(p[:len(cookieMagic)]) == cookieMagic && addr.String() == c.remote {
+			c.mu.Lock()
+			c.cookie = bytes.Clone(p[len(cookieMagic):n])
+			last := bytes.Clone(c.last)
+			c.answered.Store(false)
+			c.mu.Unlock()
+
+			if last != nil {
+				_, _ = c.WriteTo(last, addr)
+			}
+			continue
+		}
+
+		if !c.answered.Load() && addr.String() == c.remote {
+			c.mu.Lock()
+			c.cookie, c.last = nil, nil
+			c.answered.Store(true)
+			c.mu.Unlock()
+		}
+
+		return n, addr, nil
+	}
+}
@@ -0,0 +1,72 @@
+package xkcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieConn_Cookies(t *testing.T) {
+	c, err := newCookieConn(nil, &CookieConf{Always: true}, DefaultConfig().logger(), NewMetrics())
+	require.NoError(t, err)
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	now := time.Now()
+	cookie := c.cookie(addr, now.Unix()/int64(cookieLifetime/time.Second))
+
+	require.True(t, c.valid(cookie, addr, now))
+	require.True(t, c.valid(cookie, addr, now.Add(cookieLifetime)))
+	require.False(t, c.valid(cookie, addr, now.Add(2*cookieLifetime)))
+	require.False(t, c.valid(cookie, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4001}, now))
+
+	other, err := newCookieConn(nil, &CookieConf{Always: true}, DefaultConfig().logger(), NewMetrics())
+	require.NoError(t, err)
+	require.False(t, other.valid(cookie, addr, now))
+}
+
+func TestServer_CookieAlways(t *testing.T) {
+	metrics := NewMetrics()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.CookieConf = &CookieConf{Always: true}
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithConfig(conf), WithHandler(&testEchoHandler{}), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, saddr, WithConfig(conf), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+	require.EqualValues(t, 1, metrics.Snapshot().CookieChallenges)
+
+	plainCtx, plainCancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer plainCancel()
+
+	_, err = Dial(plainCtx, saddr, WithMetrics(metrics))
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+}
+
+func TestServer_CookieKeyExchange(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.Crypt = CryptAESGCM
+	conf.KeyExchangeConf = &KeyExchangeConf{}
+	conf.CookieConf = &CookieConf{Always: true}
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithConfig(conf), WithHandler(&testEchoHandler{}), WithMetrics(NewMetrics()))
+	require.NoError(t, err)
+	defer server.Close()
+
+	testKXEcho(t, saddr, conf)
+}
@@ -1,49 +1,251 @@
 package xkcp
 
 import (
+	"context"
+	"crypto/hkdf"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
 
 	"github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
 )
 
 const salt = "kcptransport"
 
-func GetBlockCrypt(seed string, crypt string) kcp.BlockCrypt {
-	pass := pbkdf2.Key([]byte(seed), []byte(salt), 4096, 32, sha1.New)
+// supportedCrypts lists the KcpConfig.Crypt values, the block ciphers of
+// NewBlockCrypt and the aead modes
+var supportedCrypts = []string{
+	"null", "sm4", "tea", "xor", "none", "aes", "aes-128", "aes-192",
+	"blowfish", "twofish", "cast5", "3des", "xtea", "salsa20",
+	CryptAESGCM, CryptChaCha20Poly1305,
+}
+
+// supportedKDFs lists the KDFConf.Algorithm values understood by DeriveKey
+var supportedKDFs = []string{KDFPBKDF2SHA1, KDFPBKDF2SHA256, KDFScrypt, KDFArgon2id, KDFHKDF}
+
+// keySize is the size of the key shared by all crypt modes
+const keySize = 32
+
+// kdfDefaults returns k with the cost fields left at zero set to the
+// defaults of its algorithm
+func kdfDefaults(k KDFConf) KDFConf {
+	if k.Salt == "" {
+		k.Salt = salt
+	}
+
+	switch k.Algorithm {
+	case KDFPBKDF2SHA1:
+		if k.Iterations == 0 {
+			k.Iterations = 4096
+		}
+	case KDFPBKDF2SHA256:
+		if k.Iterations == 0 {
+			k.Iterations = 600000
+		}
+	case KDFScrypt:
+		if k.Cost == 0 {
+			k.Cost = 32768
+		}
+		if k.BlockSize == 0 {
+			k.BlockSize = 8
+		}
+		if k.Parallelism == 0 {
+			k.Parallelism = 1
+		}
+	case KDFArgon2id:
+		if k.Iterations == 0 {
+			k.Iterations = 2
+		}
+		if k.Memory == 0 {
+			k.Memory = 19 * 1024
+		}
+		if k.Parallelism == 0 {
+			k.Parallelism = 1
+		}
+	}
 
-	var block kcp.BlockCrypt
+	return k
+}
+
+// DeriveKey returns the 32 byte cipher key selected by conf: the decoded Key
+// when set, otherwise Seed run through KDFConf
+func DeriveKey(conf *KcpConfig) ([]byte, error) {
+	if conf.Key != "" {
+		return decodeKey(conf.Key)
+	}
+
+	if conf.KDFConf == nil {
+		return legacyKey(conf.Seed), nil
+	}
+
+	k := kdfDefaults(*conf.KDFConf)
+	seed, salt := []byte(conf.Seed), []byte(k.Salt)
+
+	switch k.Algorithm {
+	case KDFPBKDF2SHA1:
+		return pbkdf2.Key(seed, salt, k.Iterations, keySize, sha1.New), nil
+	case KDFPBKDF2SHA256:
+		return pbkdf2.Key(seed, salt, k.Iterations, keySize, sha256.New), nil
+	case KDFScrypt:
+		return scrypt.Key(seed, salt, k.Cost, k.BlockSize, k.Parallelism, keySize)
+	case KDFArgon2id:
+		return argon2.IDKey(seed, salt, uint32(k.Iterations), uint32(k.Memory), uint8(k.Parallelism), keySize), nil
+	case KDFHKDF:
+		return hkdf.Key(sha256.New, seed, salt, "xkcp cipher key", keySize)
+	default:
+		return nil, fmt.Errorf("xkcp: unsupported key derivation function %q", k.Algorithm)
+	}
+}
+
+// legacyKey is the historical derivation used by GetBlockCrypt
+func legacyKey(seed string) []byte {
+	return pbkdf2.Key([]byte(seed), []byte(salt), 4096, keySize, sha1.New)
+}
+
+// decodeKey decodes a hex or standard base64 encoded 32 byte key
+func decodeKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, errors.New("must be hex or base64 encoded")
+		}
+	}
+
+	if len(key) != keySize {
+		return nil, fmt.Errorf("must be %d bytes, got %d", keySize, len(key))
+	}
+
+	return key, nil
+}
+
+// GetBlockCrypt returns the kcp block cipher for crypt keyed from seed with
+// the legacy key derivation, see NewBlockCrypt for the other derivations.
+func GetBlockCrypt(seed string, crypt string) (kcp.BlockCrypt, error) {
+	return NewBlockCrypt(legacyKey(seed), crypt)
+}
+
+// NewBlockCrypt returns the kcp block cipher for crypt keyed with a 32 byte
+// key. It returns nil for "null" and an error for the aead modes, which only
+// apply to the packet connection of a Server or Client. Unknown crypts fall
+// back to aes.
+func NewBlockCrypt(key []byte, crypt string) (kcp.BlockCrypt, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("xkcp: cipher key must be %d bytes, got %d", keySize, len(key))
+	}
 
 	switch crypt {
 	case "null":
-		block = nil
+		return nil, nil
+	case CryptAESGCM, CryptChaCha20Poly1305:
+		return nil, fmt.Errorf("xkcp: %s is not a kcp block cipher, it only applies to the packet connection", crypt)
 	case "sm4":
-		block, _ = kcp.NewSM4BlockCrypt(pass[:16])
+		return kcp.NewSM4BlockCrypt(key[:16])
 	case "tea":
-		block, _ = kcp.NewTEABlockCrypt(pass[:16])
+		return kcp.NewTEABlockCrypt(key[:16])
 	case "xor":
-		block, _ = kcp.NewSimpleXORBlockCrypt(pass)
+		return kcp.NewSimpleXORBlockCrypt(key)
 	case "none":
-		block, _ = kcp.NewNoneBlockCrypt(pass)
+		return kcp.NewNoneBlockCrypt(key)
 	case "aes-128":
-		block, _ = kcp.NewAESBlockCrypt(pass[:16])
+		return kcp.NewAESBlockCrypt(key[:16])
 	case "aes-192":
-		block, _ = kcp.NewAESBlockCrypt(pass[:24])
+		return kcp.NewAESBlockCrypt(key[:24])
 	case "blowfish":
-		block, _ = kcp.NewBlowfishBlockCrypt(pass)
+		return kcp.NewBlowfishBlockCrypt(key)
 	case "twofish":
-		block, _ = kcp.NewTwofishBlockCrypt(pass)
+		return kcp.NewTwofishBlockCrypt(key)
 	case "cast5":
-		block, _ = kcp.NewCast5BlockCrypt(pass[:16])
+		return kcp.NewCast5BlockCrypt(key[:16])
 	case "3des":
-		block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
+		return kcp.NewTripleDESBlockCrypt(key[:24])
 	case "xtea":
-		block, _ = kcp.NewXTEABlockCrypt(pass[:16])
+		return kcp.NewXTEABlockCrypt(key[:16])
 	case "salsa20":
-		block, _ = kcp.NewSalsa20BlockCrypt(pass)
+		return kcp.NewSalsa20BlockCrypt(key)
 	default:
-		block, _ = kcp.NewAESBlockCrypt(pass)
+		return kcp.NewAESBlockCrypt(key)
+	}
+}
+
+// packetCrypto derives the key selected by conf and returns it along with
+// the kcp block cipher, nil for the aead modes, the key also feeds
+// wrapPacketConn
+func packetCrypto(conf *KcpConfig) ([]byte, kcp.BlockCrypt, error) {
+	key, err := DeriveKey(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if isAEADCrypt(conf.Crypt) {
+		return key, nil, nil
+	}
+
+	block, err := NewBlockCrypt(key, conf.Crypt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, block, nil
+}
+
+// wrapPacketConn wraps conn with the packet level encryption selected by
+// crypt, it returns conn itself for the kcp block ciphers.
+func wrapPacketConn(conn net.PacketConn, crypt string, key []byte) (net.PacketConn, error) {
+	if !isAEADCrypt(crypt) {
+		return conn, nil
+	}
+
+	ac, err := newAEADConn(conn, crypt, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ac, nil
+}
+
+// wrapListenConn is wrapPacketConn for the socket of a listener, it also
+// answers the key exchange when conf enables it. Key exchange sessions are
+// kept for as long as the IdleTimeout of conf.
+func wrapListenConn(conn net.PacketConn, conf *KcpConfig, key []byte) (net.PacketConn, error) {
+	if conf.KeyExchangeConf == nil {
+		return wrapPacketConn(conn, conf.Crypt, key)
+	}
+
+	keys, err := newKXKeys(conf, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKXServerConn(conn, keys, time.Duration(conf.IdleTimeout)*time.Millisecond), nil
+}
+
+// wrapDialConn is wrapPacketConn for the socket of a client, it also runs
+// the key exchange with remote when conf enables it
+func wrapDialConn(ctx context.Context, conn net.PacketConn, remote net.Addr, conf *KcpConfig, key []byte) (net.PacketConn, error) {
+	if conf.KeyExchangeConf == nil {
+		return wrapPacketConn(conn, conf.Crypt, key)
+	}
+
+	keys, err := newKXKeys(conf, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	kc, err := newKXClientConn(ctx, conn, remote, keys)
+	if err != nil {
+		return nil, err
 	}
 
-	return block
+	return kc, nil
 }
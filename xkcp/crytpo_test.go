@@ -1,6 +1,9 @@
 package xkcp
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"testing"
 )
@@ -35,7 +38,10 @@ func TestGetBlockCrypt(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := GetBlockCrypt(tt.seed, tt.cryptType)
+			got, err := GetBlockCrypt(tt.seed, tt.cryptType)
+			if err != nil {
+				t.Fatalf("GetBlockCrypt() error = %v", err)
+			}
 			if (got == nil) != tt.wantNil {
 				t.Errorf("GetBlockCrypt() got = %v, want nil = %v", got, tt.wantNil)
 			}
@@ -51,8 +57,8 @@ func TestGetBlockCryptConsistency(t *testing.T) {
 		"blowfish", "twofish", "cast5", "3des", "xtea", "salsa20",
 	} {
 		t.Run(fmt.Sprintf("Consistency-%s", cryptType), func(t *testing.T) {
-			first := GetBlockCrypt(seed, cryptType)
-			second := GetBlockCrypt(seed, cryptType)
+			first, _ := GetBlockCrypt(seed, cryptType)
+			second, _ := GetBlockCrypt(seed, cryptType)
 
 			if first == nil || second == nil {
 				t.Fatal("unexpected nil result")
@@ -70,8 +76,8 @@ func TestGetBlockCryptConsistency(t *testing.T) {
 func TestGetBlockCryptDifferentSeeds(t *testing.T) {
 	// Test that different seeds produce different ciphers
 	cryptType := "aes-128"
-	first := GetBlockCrypt("seed1", cryptType)
-	second := GetBlockCrypt("seed2", cryptType)
+	first, _ := GetBlockCrypt("seed1", cryptType)
+	second, _ := GetBlockCrypt("seed2", cryptType)
 
 	if first == nil || second == nil {
 		t.Fatal("unexpected nil result")
@@ -83,3 +89,90 @@ func TestGetBlockCryptDifferentSeeds(t *testing.T) {
 		t.Error("different seeds produced identical ciphers")
 	}
 }
+
+func TestDeriveKey(t *testing.T) {
+	legacy, err := DeriveKey(&KcpConfig{Seed: "test-seed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(legacy, legacyKey("test-seed")) {
+		t.Error("nil KDFConf must keep the legacy key")
+	}
+
+	// low cost parameters, the defaults are deliberately slow
+	kdfs := []*KDFConf{
+		{Algorithm: KDFPBKDF2SHA1},
+		{Algorithm: KDFPBKDF2SHA256, Iterations: 1000},
+		{Algorithm: KDFScrypt, Cost: 1024},
+		{Algorithm: KDFArgon2id, Iterations: 1, Memory: 1024},
+		{Algorithm: KDFHKDF},
+	}
+
+	seen := make(map[string]string)
+	for _, kdf := range kdfs {
+		t.Run(kdf.Algorithm, func(t *testing.T) {
+			key, err := DeriveKey(&KcpConfig{Seed: "test-seed", KDFConf: kdf})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(key) != keySize {
+				t.Fatalf("got %d byte key", len(key))
+			}
+
+			salted := *kdf
+			salted.Salt = "other-salt"
+			other, err := DeriveKey(&KcpConfig{Seed: "test-seed", KDFConf: &salted})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(key, other) {
+				t.Error("salt does not change the key")
+			}
+
+			if prev, ok := seen[string(key)]; ok {
+				t.Errorf("same key as %s", prev)
+			}
+			seen[string(key)] = kdf.Algorithm
+		})
+	}
+
+	// the pbkdf2-sha1 defaults are the legacy derivation
+	if prev := seen[string(legacy)]; prev != KDFPBKDF2SHA1 {
+		t.Errorf("legacy key derived by %q", prev)
+	}
+}
+
+func TestDeriveKeyRaw(t *testing.T) {
+	raw := bytes.Repeat([]byte{0x5a}, keySize)
+
+	for _, encoded := range []string{hex.EncodeToString(raw), base64.StdEncoding.EncodeToString(raw)} {
+		key, err := DeriveKey(&KcpConfig{Seed: "ignored", Key: encoded, KDFConf: &KDFConf{Algorithm: KDFHKDF}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, raw) {
+			t.Errorf("DeriveKey(%q) = %x", encoded, key)
+		}
+	}
+
+	for _, bad := range []string{"zz", hex.EncodeToString(raw[:16]), "not base64!"} {
+		if _, err := DeriveKey(&KcpConfig{Key: bad}); err == nil {
+			t.Errorf("DeriveKey(%q) accepted", bad)
+		}
+	}
+}
+
+func TestNewBlockCryptKeySize(t *testing.T) {
+	if _, err := NewBlockCrypt(make([]byte, 16), "aes"); err == nil {
+		t.Error("short key accepted")
+	}
+}
+
+func TestNewBlockCryptAEAD(t *testing.T) {
+	// the aead modes would leave kcp-go without encryption
+	for _, crypt := range []string{CryptAESGCM, CryptChaCha20Poly1305} {
+		if block, err := NewBlockCrypt(legacyKey("test-seed"), crypt); err == nil {
+			t.Errorf("NewBlockCrypt(%q) = %v, want an error", crypt, block)
+		}
+	}
+}
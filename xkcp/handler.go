@@ -0,0 +1,95 @@
+package xkcp
+
+import (
+	"context"
+	"net"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// ContextHandler handles the sessions of a Server, see WithContextHandler.
+// ctx is cancelled when the server shuts down, with ErrServerClosed as its
+// cause, or when the server closes the session. The error ServeConn returns
+// is logged and passed to Hooks.OnClose. Like a ServerConnHandler, a
+// ContextHandler may also implement ServerStreamHandler and Authorizer.
+type ContextHandler interface {
+	ServeConn(ctx context.Context, conn *Conn) error
+}
+
+// HandlerFunc adapts a function to ContextHandler
+type HandlerFunc func(ctx context.Context, conn *Conn) error
+
+// ServeConn calls f(ctx, conn)
+func (f HandlerFunc) ServeConn(ctx context.Context, conn *Conn) error {
+	return f(ctx, conn)
+}
+
+// connHandler runs a ServerConnHandler as a ContextHandler, on the raw
+// session and without an error
+type connHandler struct {
+	ServerConnHandler
+}
+
+func (h connHandler) ServeConn(_ context.Context, conn *Conn) error {
+	h.Handle(conn.Session())
+	return nil
+}
+
+// handlerImpl returns the handler a Server was given, for its optional
+// interfaces
+func handlerImpl(h ContextHandler) any {
+	if c, ok := h.(connHandler); ok {
+		return c.ServerConnHandler
+	}
+	return h
+}
+
+// Conn is a session handed to a ContextHandler. Its reads and writes count
+// against the rate limits of the server, see Server.Limited, and fail with
+// ErrIdleTimeout once the server closed the session for being idle.
+type Conn struct {
+	net.Conn
+
+	session *kcp.UDPSession
+	id      *Identity
+	server  *Server
+}
+
+func newConn(s *Server, session *kcp.UDPSession, id *Identity) *Conn {
+	return &Conn{Conn: s.Limited(session), session: session, id: id, server: s}
+}
+
+// Session returns the underlying KCP session, its traffic is not rate limited
+func (c *Conn) Session() *kcp.UDPSession {
+	return c.session
+}
+
+// Conv returns the conversation ID of the session
+func (c *Conn) Conv() uint32 {
+	return c.session.GetConv()
+}
+
+// Identity returns who the client authenticated as, nil when AuthConf does
+// not require authentication
+func (c *Conn) Identity() *Identity {
+	return c.id
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	return n, c.sessionErr(err)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	return n, c.sessionErr(err)
+}
+
+// sessionErr returns ErrIdleTimeout in place of err when the server closed
+// the session for being idle
+func (c *Conn) sessionErr(err error) error {
+	if err != nil && c.server.closeReason(c.session) == ClosedIdle {
+		return ErrIdleTimeout
+	}
+	return err
+}
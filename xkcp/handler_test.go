@@ -0,0 +1,167 @@
+package xkcp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errTestHandler = errors.New("test handler failed")
+
+// testContextEcho echoes one read and fails
+func testContextEcho(ctx context.Context, conn *Conn) error {
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(buf[:n]); err != nil {
+		return err
+	}
+	return errTestHandler
+}
+
+// testContextEchoLoop echoes until reading fails
+func testContextEchoLoop(ctx context.Context, conn *Conn) error {
+	buf := make([]byte, 64)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+func TestServer_ContextHandler(t *testing.T) {
+	hooks := newTestHooks()
+	logs := &testLogHandler{level: slog.LevelWarn}
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithContextHandler(HandlerFunc(testContextEcho)),
+		WithHooks(hooks), WithLogger(slog.New(logs)))
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, client)
+
+	hooks.next(t, "accept")
+	e := hooks.next(t, "close")
+	require.Equal(t, ClosedByHandler, e.reason)
+	require.True(t, errors.Is(e.err, errTestHandler), "unexpected error: %v", e.err)
+
+	attrs := logs.eventually(t, "xkcp: handler failed")
+	require.Equal(t, errTestHandler.Error(), attrs["err"])
+}
+
+func TestServer_ContextHandlerShutdown(t *testing.T) {
+	hooks := newTestHooks()
+	handler := HandlerFunc(func(ctx context.Context, conn *Conn) error {
+		<-ctx.Done()
+		return context.Cause(ctx)
+	})
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithContextHandler(handler), WithHooks(hooks))
+	require.NoError(t, err)
+
+	_, err = testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	hooks.next(t, "accept")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the handler returns on its own, nothing is dropped
+	dropped, err := server.Shutdown(ctx)
+	require.NoError(t, err)
+	require.Zero(t, dropped)
+
+	e := hooks.next(t, "close")
+	require.Equal(t, ClosedByHandler, e.reason)
+	require.True(t, errors.Is(e.err, ErrServerClosed), "unexpected error: %v", e.err)
+}
+
+func TestServer_ContextHandlerClosed(t *testing.T) {
+	hooks := newTestHooks()
+	handler := HandlerFunc(func(ctx context.Context, conn *Conn) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithContextHandler(handler), WithHooks(hooks))
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	hooks.next(t, "accept")
+
+	require.Equal(t, 1, server.CloseSession(client.GetConv()))
+
+	e := hooks.next(t, "close")
+	require.Equal(t, ClosedForced, e.reason)
+	require.True(t, errors.Is(e.err, context.Canceled), "unexpected error: %v", e.err)
+}
+
+func TestServer_ContextHandlerIdle(t *testing.T) {
+	hooks := newTestHooks()
+
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.IdleTimeout = 300
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithConfig(conf),
+		WithContextHandler(HandlerFunc(testContextEchoLoop)), WithHooks(hooks))
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, client)
+	hooks.next(t, "accept")
+
+	client.Close()
+
+	e := hooks.next(t, "close")
+	require.Equal(t, ClosedIdle, e.reason)
+	require.True(t, errors.Is(e.err, ErrIdleTimeout), "unexpected error: %v", e.err)
+}
+
+func TestServer_ContextHandlerIdentity(t *testing.T) {
+	ids := make(chan *Identity, 1)
+	handler := HandlerFunc(func(ctx context.Context, conn *Conn) error {
+		var a Authenticated = conn
+		ids <- a.Identity()
+		return testContextEchoLoop(ctx, conn)
+	})
+
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.AuthConf = &AuthConf{Tokens: map[string]string{"alice": "alice-token"}}
+	server, err := StartServer(saddr, WithConfig(conf),
+		WithContextHandler(handler))
+	require.NoError(t, err)
+	defer server.Close()
+
+	alice := DefaultConfig()
+	alice.Handshake = true
+	alice.AuthConf = &AuthConf{Token: "alice-token"}
+	_, err = testAuthDial(t, saddr, alice)
+	require.NoError(t, err)
+
+	id := <-ids
+	require.NotNil(t, id)
+	require.Equal(t, "alice", id.Name)
+}
@@ -0,0 +1,343 @@
+package xkcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// With KcpConfig.Handshake every xkcp session starts with a small preamble
+// exchanged over the KCP stream before any application data:
+//
+//	client -> server: hello       (requested flags)
+//	server -> client: hello-ack   (accepted flags, only when the hello asked for one)
+//
+// A server over its LimitConf may answer the hello with a refusal instead:
+//
+//	server -> client: refused     (reject reason)
+//
+// When the server requires authentication (see AuthConf) the hello-ack also
+// carries a server nonce and two more frames follow:
+//
+//	client -> server: auth        (client nonce, method, proof)
+//	server -> client: auth-result (status, server certificate proof)
+//
+// Each frame is a fixed header followed by a payload:
+//
+//	magic[4] | version[1] | type[1] | length[2, big endian] | payload[length]
+const (
+	frameMagic      = "XKCP"
+	frameVersion    = 1
+	frameHeaderSize = 8
+	frameMaxPayload = 16384 // room for certificate chains
+
+	frameHello      = 0x01
+	frameHelloAck   = 0x02
+	frameAuth       = 0x03
+	frameAuthResult = 0x04
+	frameRefused    = 0x05
+)
+
+// hello flags
+const (
+	// flagAckRequested asks the server to answer the hello, which lets the
+	// client prove the peer is alive before returning from a dial.
+	flagAckRequested = 1 << 0
+
+	// flagMux asks for smux stream multiplexing on top of the session.
+	flagMux = 1 << 1
+
+	// flagAuth announces a client credential. In the hello-ack it tells the
+	// client that the server requires one.
+	flagAuth = 1 << 2
+)
+
+// handshakeTimeout bounds how long the server waits for the hello of a new session.
+const handshakeTimeout = 10 * time.Second
+
+var (
+	// ErrBadHandshake is returned when the peer does not speak the xkcp preamble.
+	ErrBadHandshake = errors.New("xkcp: bad handshake")
+
+	// ErrMuxRejected is returned by a dial when mux is enabled locally but the server refused it.
+	ErrMuxRejected = errors.New("xkcp: server does not accept stream multiplexing")
+
+	// ErrRefused is returned by a dial when the server is over one of its
+	// limits and set LimitConf.Refuse.
+	ErrRefused = errors.New("xkcp: session refused by server")
+)
+
+type frame struct {
+	typ     byte
+	payload []byte
+}
+
+// writeFrame writes a single preamble frame to w
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	if len(payload) > frameMaxPayload {
+		return fmt.Errorf("%w: frame payload too large (%d bytes)", ErrBadHandshake, len(payload))
+	}
+
+	buf := make([]byte, frameHeaderSize+len(payload))
+	copy(buf, frameMagic)
+	buf[4] = frameVersion
+	buf[5] = typ
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads a single preamble frame from r
+func readFrame(r io.Reader) (*frame, error) {
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if string(hdr[:4]) != frameMagic {
+		return nil, fmt.Errorf("%w: unexpected magic %q", ErrBadHandshake, hdr[:4])
+	}
+
+	if hdr[4] != frameVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadHandshake, hdr[4])
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[6:]))
+	if n > frameMaxPayload {
+		return nil, fmt.Errorf("%w: frame payload too large (%d bytes)", ErrBadHandshake, n)
+	}
+
+	f := &frame{typ: hdr[5], payload: make([]byte, n)}
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// clientHandshake sends the hello on a freshly created session. When wait is
+// true it also blocks until the server acknowledges it or ctx is done, and
+// returns the flags the server accepted. Otherwise every flag is assumed
+// accepted. A client credential is always presented and forces wait, the
+// server identity is returned when auth verifies servers.
+func clientHandshake(ctx context.Context, conn *kcp.UDPSession, flags byte, wait bool, auth *clientAuth) (byte, *Identity, error) {
+	if auth != nil {
+		flags |= flagAuth
+		wait = true
+	}
+
+	if wait {
+		flags |= flagAckRequested
+	}
+
+	if err := writeFrame(conn, frameHello, []byte{flags}); err != nil {
+		return 0, nil, err
+	}
+
+	if !wait {
+		return flags, nil, nil
+	}
+
+	// kcp-go does not re-arm a read that started without a deadline, so
+	// cancellation and ctx deadlines unblock the pending read by closing the session
+	closed := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		close(closed)
+	})
+
+	accepted, server, err := clientExchange(conn, auth)
+	if !stop() {
+		// ctx fired and the session is gone, wait for it to release its socket
+		<-closed
+		return 0, nil, ctx.Err()
+	}
+
+	return accepted, server, err
+}
+
+// clientExchange reads the hello-ack and authenticates when the server asks for it
+func clientExchange(conn *kcp.UDPSession, auth *clientAuth) (byte, *Identity, error) {
+	f, err := readFrame(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if f.typ == frameRefused {
+		return 0, nil, fmt.Errorf("%w: %s", ErrRefused, f.payload)
+	}
+
+	if f.typ != frameHelloAck || len(f.payload) < 1 {
+		return 0, nil, fmt.Errorf("%w: expected hello-ack, got frame type %#x", ErrBadHandshake, f.typ)
+	}
+
+	accepted := f.payload[0]
+	if accepted&flagAuth == 0 {
+		if auth != nil && auth.roots != nil {
+			return 0, nil, fmt.Errorf("%w: server does not authenticate", ErrAuthFailed)
+		}
+		return accepted, nil, nil
+	}
+
+	if auth == nil {
+		return 0, nil, fmt.Errorf("%w: server requires a client credential", ErrAuthFailed)
+	}
+
+	if len(f.payload) != 1+authNonceSize {
+		return 0, nil, fmt.Errorf("%w: hello-ack without server nonce", ErrBadHandshake)
+	}
+	serverNonce := f.payload[1:]
+
+	clientNonce := make([]byte, authNonceSize)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return 0, nil, err
+	}
+
+	proof, err := auth.proof(conn.GetConv(), serverNonce, clientNonce)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if err := writeFrame(conn, frameAuth, proof); err != nil {
+		return 0, nil, err
+	}
+
+	if f, err = readFrame(conn); err != nil {
+		return 0, nil, err
+	}
+
+	if f.typ != frameAuthResult || len(f.payload) < 1 {
+		return 0, nil, fmt.Errorf("%w: expected auth-result, got frame type %#x", ErrBadHandshake, f.typ)
+	}
+
+	if f.payload[0] != authOK {
+		return 0, nil, ErrAuthRejected
+	}
+
+	server, err := auth.verify(conn.GetConv(), serverNonce, clientNonce, f.payload[1:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return accepted, server, nil
+}
+
+// serverHandshake reads the hello of a newly accepted session and answers it
+// when the client asked for an acknowledgement. It returns the flags the
+// client requested, the ack carries only those also present in supported.
+// With auth the client must authenticate, authorize (if not nil) then
+// decides whether the client identity, nil without auth, may proceed.
+// Without preamble the session starts with application data and only
+// authorize runs.
+func serverHandshake(conn *kcp.UDPSession, preamble bool, supported byte, auth *serverAuth, authorize func(*Identity) error) (byte, *Identity, error) {
+	if !preamble {
+		return 0, nil, authorizeAnonymous(authorize)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+
+	f, err := readFrame(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if f.typ != frameHello || len(f.payload) < 1 {
+		return 0, nil, fmt.Errorf("%w: expected hello, got frame type %#x", ErrBadHandshake, f.typ)
+	}
+
+	requested := f.payload[0]
+	ack := []byte{requested & supported}
+
+	var serverNonce []byte
+	if auth != nil {
+		// also tells clients without a credential that they need one
+		ack[0] |= flagAuth
+
+		if requested&flagAuth != 0 {
+			serverNonce = make([]byte, authNonceSize)
+			if _, err := rand.Read(serverNonce); err != nil {
+				return 0, nil, err
+			}
+			ack = append(ack, serverNonce...)
+		}
+	}
+
+	if requested&flagAckRequested != 0 {
+		if err := writeFrame(conn, frameHelloAck, ack); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	var id *Identity
+	switch {
+	case auth != nil && requested&flagAuth == 0:
+		return 0, nil, fmt.Errorf("%w: client sent no credential", ErrAuthFailed)
+	case auth != nil:
+		if id, err = serverAuthenticate(conn, auth, serverNonce, authorize); err != nil {
+			return 0, nil, err
+		}
+	default:
+		if err := authorizeAnonymous(authorize); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return requested, id, conn.SetReadDeadline(time.Time{})
+}
+
+// authorizeAnonymous lets authorize, if not nil, decide on a client that did
+// not authenticate
+func authorizeAnonymous(authorize func(*Identity) error) error {
+	if authorize == nil {
+		return nil
+	}
+
+	if err := authorize(nil); err != nil {
+		return fmt.Errorf("%w: %v", ErrAuthRejected, err)
+	}
+	return nil
+}
+
+// serverAuthenticate verifies the auth frame of a client and answers it
+func serverAuthenticate(conn *kcp.UDPSession, auth *serverAuth, serverNonce []byte, authorize func(*Identity) error) (*Identity, error) {
+	f, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.typ != frameAuth {
+		return nil, fmt.Errorf("%w: expected auth, got frame type %#x", ErrBadHandshake, f.typ)
+	}
+
+	id, clientNonce, err := auth.verify(conn.GetConv(), serverNonce, f.payload)
+	if err == nil && authorize != nil {
+		if aerr := authorize(id); aerr != nil {
+			err = fmt.Errorf("%w: %v", ErrAuthRejected, aerr)
+		}
+	}
+
+	if err != nil {
+		// best effort, lets the client fail fast
+		_ = writeFrame(conn, frameAuthResult, []byte{authRejected})
+		return nil, err
+	}
+
+	proof, err := auth.proof(conn.GetConv(), serverNonce, clientNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFrame(conn, frameAuthResult, append([]byte{authOK}, proof...)); err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
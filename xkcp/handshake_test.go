@@ -0,0 +1,47 @@
+package xkcp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeFrame(&buf, frameHello, []byte{flagAckRequested}))
+	require.NoError(t, writeFrame(&buf, frameHelloAck, nil))
+
+	f, err := readFrame(&buf)
+	require.NoError(t, err)
+	require.Equal(t, byte(frameHello), f.typ)
+	require.Equal(t, []byte{flagAckRequested}, f.payload)
+
+	f, err = readFrame(&buf)
+	require.NoError(t, err)
+	require.Equal(t, byte(frameHelloAck), f.typ)
+	require.Empty(t, f.payload)
+}
+
+func TestReadFrame_BadMagic(t *testing.T) {
+	_, err := readFrame(bytes.NewReader([]byte("hello world!")))
+	require.True(t, errors.Is(err, ErrBadHandshake))
+}
+
+func TestReadFrame_BadVersion(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeFrame(&buf, frameHello, []byte{0}))
+	raw := buf.Bytes()
+	raw[4] = frameVersion + 1
+
+	_, err := readFrame(bytes.NewReader(raw))
+	require.True(t, errors.Is(err, ErrBadHandshake))
+}
+
+func TestWriteFrame_TooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeFrame(&buf, frameHello, make([]byte, frameMaxPayload+1))
+	require.True(t, errors.Is(err, ErrBadHandshake))
+	require.Zero(t, buf.Len())
+}
@@ -0,0 +1,52 @@
+package xkcp
+
+import "github.com/xtaci/kcp-go/v5"
+
+// Reasons a session accepted by a Server closed for, as passed to
+// Hooks.OnClose
+const (
+	ClosedByHandler = "handler" // the handler returned, or the client ended its multiplexed session
+	ClosedIdle      = "idle"    // nothing was received for IdleTimeout
+	ClosedByServer  = "server"  // Close, Shutdown running out of time, or a session the server cannot serve
+	ClosedForced    = "forced"  // CloseSession
+	ClosedPanic     = "panic"   // a handler of the session panicked, see PanicError
+	ClosedEvicted   = "evicted" // closed to make room in a full pool, see PoolFullCloseIdle
+)
+
+// Reasons a Server turns a session away for besides RejectReasons, as passed
+// to Hooks.OnReject
+const (
+	RejectHandshake = "handshake" // see MetricsSnapshot.HandshakeFailures
+	RejectShutdown  = "shutdown"
+)
+
+// Hooks observes the sessions of a Server, see WithHooks. Hooks are called
+// from the goroutines of the server, concurrently for different sessions, and
+// should return quickly. Embed NopHooks to implement only some of them.
+type Hooks interface {
+	// OnAccept is called when a session completed its handshake, before its
+	// handler runs. id is nil unless the client authenticated.
+	OnAccept(conn *kcp.UDPSession, id *Identity)
+
+	// OnReject is called when a session is closed before its handshake
+	// completed. reason is one of RejectReasons, RejectHandshake or
+	// RejectShutdown, err is the handshake error.
+	OnReject(conn *kcp.UDPSession, reason string, err error)
+
+	// OnClose is called once an accepted session is gone, with the reason
+	// it closed for, the error its ContextHandler returned and its stats at
+	// the time
+	OnClose(conn *kcp.UDPSession, reason string, err error, stats SessionStats)
+
+	// OnAcceptError is called when the listener fails to accept a session,
+	// which stops the server, see Server.Err
+	OnAcceptError(err error)
+}
+
+// NopHooks implements Hooks with methods that do nothing
+type NopHooks struct{}
+
+func (NopHooks) OnAccept(*kcp.UDPSession, *Identity)                  {}
+func (NopHooks) OnReject(*kcp.UDPSession, string, error)              {}
+func (NopHooks) OnClose(*kcp.UDPSession, string, error, SessionStats) {}
+func (NopHooks) OnAcceptError(error)                                  {}
@@ -0,0 +1,214 @@
+package xkcp
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// testHookEvent is an event recorded by testHooks
+type testHookEvent struct {
+	hook   string
+	conv   uint32
+	id     *Identity
+	reason string
+	err    error
+	stats  SessionStats
+}
+
+// testHooks records the events it is given
+type testHooks struct {
+	events chan testHookEvent
+}
+
+func newTestHooks() *testHooks {
+	return &testHooks{events: make(chan testHookEvent, 64)}
+}
+
+func (h *testHooks) OnAccept(conn *kcp.UDPSession, id *Identity) {
+	h.events <- testHookEvent{hook: "accept", conv: conn.GetConv(), id: id}
+}
+
+func (h *testHooks) OnReject(conn *kcp.UDPSession, reason string, err error) {
+	h.events <- testHookEvent{hook: "reject", conv: conn.GetConv(), reason: reason, err: err}
+}
+
+func (h *testHooks) OnClose(conn *kcp.UDPSession, reason string, err error, stats SessionStats) {
+	h.events <- testHookEvent{hook: "close", conv: conn.GetConv(), reason: reason, err: err, stats: stats}
+}
+
+func (h *testHooks) OnAcceptError(err error) {
+	h.events <- testHookEvent{hook: "accept error", err: err}
+}
+
+// next returns the next event, which must be hook
+func (h *testHooks) next(t *testing.T, hook string) testHookEvent {
+	t.Helper()
+
+	select {
+	case e := <-h.events:
+		require.Equal(t, hook, e.hook)
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s event", hook)
+		return testHookEvent{}
+	}
+}
+
+// testOnceEchoHandler echoes one read and returns
+type testOnceEchoHandler struct{}
+
+func (h *testOnceEchoHandler) Handle(conn *kcp.UDPSession) {
+	defer conn.Close()
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	conn.Write(buf[:n])
+}
+
+func TestServer_HooksHandlerReturned(t *testing.T) {
+	hooks := newTestHooks()
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithHandler(&testOnceEchoHandler{}), WithHooks(hooks))
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, client)
+
+	e := hooks.next(t, "accept")
+	require.Equal(t, client.GetConv(), e.conv)
+	require.Nil(t, e.id)
+
+	e = hooks.next(t, "close")
+	require.Equal(t, client.GetConv(), e.conv)
+	require.Equal(t, ClosedByHandler, e.reason)
+	require.Equal(t, RoleServer, e.stats.Role)
+	require.Equal(t, client.GetConv(), e.stats.Conv)
+	require.False(t, e.stats.Since.IsZero())
+}
+
+func TestServer_HooksServerClosed(t *testing.T) {
+	hooks := newTestHooks()
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithHandler(&testEchoHandler{}), WithHooks(hooks))
+	require.NoError(t, err)
+
+	client, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, client)
+	hooks.next(t, "accept")
+
+	server.Close()
+	e := hooks.next(t, "close")
+	require.Equal(t, ClosedByServer, e.reason)
+}
+
+func TestServer_HooksIdle(t *testing.T) {
+	hooks := newTestHooks()
+
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.IdleTimeout = 300
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithConfig(conf),
+		WithHandler(&testEchoHandler{}), WithHooks(hooks))
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, client)
+	hooks.next(t, "accept")
+
+	// the server stops hearing from the client
+	client.Close()
+	e := hooks.next(t, "close")
+	require.Equal(t, ClosedIdle, e.reason)
+}
+
+func TestServer_HooksReject(t *testing.T) {
+	hooks := newTestHooks()
+
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.LimitConf = &LimitConf{MaxSessions: 1, Refuse: true}
+	server, err := StartServer(saddr, WithConfig(conf),
+		WithHandler(&testEchoHandler{}), WithHooks(hooks))
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, client)
+	hooks.next(t, "accept")
+
+	_, err = testLimitsDial(t, saddr, 5*time.Second)
+	require.True(t, errors.Is(err, ErrRefused), "unexpected error: %v", err)
+
+	e := hooks.next(t, "reject")
+	require.Equal(t, RejectMaxSessions, e.reason)
+	require.NoError(t, e.err)
+}
+
+func TestServer_HooksHandshakeFailed(t *testing.T) {
+	hooks := newTestHooks()
+
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.AuthConf = &AuthConf{Tokens: map[string]string{"alice": "alice-token"}}
+	server, err := StartServer(saddr, WithConfig(conf),
+		WithHandler(&testEchoHandler{}), WithHooks(hooks))
+	require.NoError(t, err)
+	defer server.Close()
+
+	wrong := DefaultConfig()
+	wrong.Handshake = true
+	wrong.AuthConf = &AuthConf{Token: "wrong-token"}
+	_, err = testAuthDial(t, saddr, wrong)
+	require.Error(t, err)
+
+	e := hooks.next(t, "reject")
+	require.Equal(t, RejectHandshake, e.reason)
+	require.Error(t, e.err)
+
+	// the session was never accepted
+	select {
+	case e := <-hooks.events:
+		t.Fatalf("unexpected %s event", e.hook)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServer_HooksAcceptError(t *testing.T) {
+	hooks := newTestHooks()
+
+	conn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+
+	server, err := StartServer("", WithPacketConn(plainPacketConn{conn}), WithHandler(&testEchoHandler{}),
+		WithHooks(hooks), WithBestEffortSocketOptions(), WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	require.NoError(t, err)
+	defer server.Close()
+
+	// the socket is closed behind the back of the server
+	conn.Close()
+
+	e := hooks.next(t, "accept error")
+	require.True(t, errors.Is(e.err, net.ErrClosed), "unexpected error: %v", e.err)
+}
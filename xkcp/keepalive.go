@@ -0,0 +1,150 @@
+package xkcp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout is returned by a Client whose server stopped sending for
+// KcpConfig.IdleTimeout, idle server sessions are closed and logged with it.
+var ErrIdleTimeout = errors.New("xkcp: session idle timeout")
+
+// keepaliveProbe is sent on sessions that have been quiet for
+// KcpConfig.KeepAlive. No KCP packet can be mistaken for it, kcp-go never
+// sends datagrams shorter than the 24 byte KCP header.
+var keepaliveProbe = []byte("xkcp-keepalive")
+
+// minKeepaliveTick bounds how often idle sessions are checked
+const minKeepaliveTick = 10 * time.Millisecond
+
+// keepaliveConn sits right below KCP. It records when every tracked peer was
+// last heard from and last sent to, and swallows the probes it receives.
+type keepaliveConn struct {
+	socketOptions
+
+	mu    sync.Mutex
+	peers map[string]*keepalivePeer
+}
+
+type keepalivePeer struct {
+	lastRecv atomic.Int64 // unix nanoseconds
+	lastSent atomic.Int64
+}
+
+func newKeepaliveConn(conn net.PacketConn) *keepaliveConn {
+	return &keepaliveConn{
+		socketOptions: socketOptions{conn},
+		peers:         make(map[string]*keepalivePeer),
+	}
+}
+
+// keepaliveEnabled reports whether conf asks for probes or idle timeouts
+func keepaliveEnabled(conf *KcpConfig) bool {
+	return conf.KeepAlive > 0 || conf.IdleTimeout > 0
+}
+
+// trackPeers reports whether a listener for conf records the traffic of its
+// peers, for keepalives or to find idle sessions for PoolFullCloseIdle
+func trackPeers(conf *KcpConfig) bool {
+	return keepaliveEnabled(conf) || conf.PoolConf != nil && conf.PoolConf.Full == PoolFullCloseIdle
+}
+
+// keepaliveTick returns how often the sessions of conf are checked
+func keepaliveTick(conf *KcpConfig) time.Duration {
+	d := conf.KeepAlive
+	if d == 0 || conf.IdleTimeout > 0 && conf.IdleTimeout < d {
+		d = conf.IdleTimeout
+	}
+
+	return max(time.Duration(d)*time.Millisecond/4, minKeepaliveTick)
+}
+
+// track starts recording the traffic of addr for a new session and returns
+// its record. Only tracked peers are kept so that spoofed sources cannot grow
+// the table. A session replacing another one from the same address, as
+// kcp-go does for a new conversation, takes over the address.
+func (c *keepaliveConn) track(addr net.Addr) *keepalivePeer {
+	p := &keepalivePeer{}
+	now := time.Now().UnixNano()
+	p.lastRecv.Store(now)
+	p.lastSent.Store(now)
+
+	c.mu.Lock()
+	c.peers[addr.String()] = p
+	c.mu.Unlock()
+
+	return p
+}
+
+// untrack stops recording the traffic of addr, unless another session took
+// over the address since p was tracked
+func (c *keepaliveConn) untrack(addr net.Addr, p *keepalivePeer) {
+	c.mu.Lock()
+	if c.peers[addr.String()] == p {
+		delete(c.peers, addr.String())
+	}
+	c.mu.Unlock()
+}
+
+func (c *keepaliveConn) peer(addr net.Addr) *keepalivePeer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.peers[addr.String()]
+}
+
+// WriteTo sends p to addr and records the time
+func (c *keepaliveConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if err == nil {
+		if peer := c.peer(addr); peer != nil {
+			peer.lastSent.Store(time.Now().UnixNano())
+		}
+	}
+
+	return n, err
+}
+
+// ReadFrom returns the next datagram that is not a probe and records the
+// time of every datagram, probes included
+func (c *keepaliveConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		if peer := c.peer(addr); peer != nil {
+			peer.lastRecv.Store(time.Now().UnixNano())
+		}
+
+		if !bytes.Equal(p[:n], keepaliveProbe) {
+			return n, addr, nil
+		}
+	}
+}
+
+// check probes addr when nothing was sent to peer for keepalive and reports
+// whether nothing was received from it for idle. Zero durations disable
+// either, a nil peer is never idle.
+func (c *keepaliveConn) check(addr net.Addr, peer *keepalivePeer, keepalive, idle time.Duration) bool {
+	if peer == nil {
+		return false
+	}
+
+	now := time.Now()
+	if idle > 0 && now.Sub(time.Unix(0, peer.lastRecv.Load())) >= idle {
+		return true
+	}
+
+	if keepalive > 0 && now.Sub(time.Unix(0, peer.lastSent.Load())) >= keepalive {
+		// best effort, a lost probe is covered by the next one
+		_, _ = c.WriteTo(keepaliveProbe, addr)
+	}
+
+	return false
+}
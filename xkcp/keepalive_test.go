@@ -0,0 +1,207 @@
+package xkcp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepalive_Probes(t *testing.T) {
+	a, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+	defer a.Close()
+
+	b, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+	defer b.Close()
+
+	ka := newKeepaliveConn(a)
+	peer := ka.track(b.LocalAddr())
+	before := peer.lastRecv.Load()
+
+	_, err = b.WriteTo(keepaliveProbe, a.LocalAddr())
+	require.NoError(t, err)
+	_, err = b.WriteTo([]byte("data"), a.LocalAddr())
+	require.NoError(t, err)
+
+	// the probe is swallowed but counts as traffic
+	buf := make([]byte, 64)
+	ka.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := ka.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(buf[:n]))
+	require.Greater(t, peer.lastRecv.Load(), before)
+
+	// a quiet peer is probed, a silent one is idle
+	require.False(t, ka.check(b.LocalAddr(), peer, time.Nanosecond, time.Hour))
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err = b.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, keepaliveProbe, buf[:n])
+	require.True(t, ka.check(b.LocalAddr(), peer, 0, time.Nanosecond))
+
+	// a new session from the address takes it over
+	next := ka.track(b.LocalAddr())
+	ka.untrack(b.LocalAddr(), peer)
+	require.Same(t, next, ka.peer(b.LocalAddr()))
+
+	ka.untrack(b.LocalAddr(), next)
+	require.Nil(t, ka.peer(b.LocalAddr()))
+	require.False(t, ka.check(b.LocalAddr(), nil, 0, time.Nanosecond))
+}
+
+func TestKeepalive_KeepsSessionOpen(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.KeepAlive = 50
+	conf.IdleTimeout = 300
+	metrics := NewMetrics()
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithConfig(conf), WithHandler(&testEchoHandler{}), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, saddr, WithConfig(conf), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+	time.Sleep(time.Second)
+	testEcho(t, client)
+
+	require.Zero(t, metrics.Snapshot().IdleTimeouts)
+}
+
+func TestKeepalive_ClientIdleTimeout(t *testing.T) {
+	h := &testLogHandler{level: slog.LevelDebug}
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.KeepAlive = 50
+	conf.IdleTimeout = 300
+	metrics := NewMetrics()
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithConfig(conf), WithHandler(&testEchoHandler{}))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, saddr, WithConfig(conf), WithMetrics(metrics), WithLogger(slog.New(h)))
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+	server.Close()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Read(make([]byte, 16))
+	require.True(t, errors.Is(err, ErrIdleTimeout), "unexpected error: %v", err)
+
+	_, err = client.Write([]byte("hello"))
+	require.True(t, errors.Is(err, ErrIdleTimeout), "unexpected error: %v", err)
+
+	require.EqualValues(t, 1, metrics.Snapshot().IdleTimeouts)
+	attrs := h.eventually(t, "xkcp: session idle, closing")
+	require.Equal(t, saddr, attrs["remote"])
+}
+
+func TestKeepalive_ServerIdleTimeout(t *testing.T) {
+	h := &testLogHandler{level: slog.LevelDebug}
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.IdleTimeout = 300
+	metrics := NewMetrics()
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr,
+		WithConfig(conf),
+		WithHandler(&testEchoHandler{}),
+		WithMetrics(metrics),
+		WithLogger(slog.New(h)),
+	)
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the client neither probes nor times out
+	client, err := Dial(ctx, saddr, WithMetrics(metrics))
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+
+	attrs := h.eventually(t, "xkcp: session idle, closing")
+	_, port, _ := net.SplitHostPort(client.LocalAddr().String())
+	require.Equal(t, net.JoinHostPort("127.0.0.1", port), attrs["remote"])
+	require.Equal(t, ErrIdleTimeout.Error(), attrs["err"])
+	require.EqualValues(t, 1, metrics.Snapshot().IdleTimeouts)
+
+	require.Eventually(t, func() bool {
+		_, ok := findSession(metrics.Snapshot(), RoleServer, client.GetConv())
+		return !ok
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestKeepalive_ReplacedSession(t *testing.T) {
+	hooks := newTestHooks()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.IdleTimeout = 300
+	conf.CookieConf = &CookieConf{Threshold: 1000}
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithConfig(conf), WithHandler(&testEchoHandler{}), WithHooks(hooks))
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a client reconnecting from the same port replaces its session
+	caddr := getTestAddr()
+	first, err := Dial(ctx, saddr, WithConfig(conf), WithLocalAddr(caddr))
+	require.NoError(t, err)
+	testEcho(t, first)
+	hooks.next(t, "accept")
+	first.Close()
+
+	second, err := Dial(ctx, saddr, WithConfig(conf), WithLocalAddr(caddr))
+	require.NoError(t, err)
+	defer second.Close()
+	testEcho(t, second)
+
+	// the replaced session may close before or after the new one is accepted
+	events := map[string]uint32{}
+	for range 2 {
+		select {
+		case e := <-hooks.events:
+			events[e.hook] = e.conv
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+	}
+	require.Equal(t, map[string]uint32{"accept": second.GetConv(), "close": first.GetConv()}, events)
+
+	// the new session is still tracked and idle-closed
+	require.NotNil(t, server.keepalive.peer(second.LocalAddr()))
+	server.cookie.mu.Lock()
+	_, known := server.cookie.known[second.LocalAddr().String()]
+	server.cookie.mu.Unlock()
+	require.True(t, known)
+
+	e := hooks.next(t, "close")
+	require.Equal(t, second.GetConv(), e.conv)
+	require.Equal(t, ClosedIdle, e.reason)
+}
@@ -0,0 +1,651 @@
+package xkcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// With KeyExchangeConf every datagram starts with its type and the session
+// id picked at random by the client:
+//
+//	init  1 | session[8] | ephemeral[32] | static[32] | tag[16]
+//	resp  2 | session[8] | ephemeral[32] | tag[16]
+//	data  3 | session[8] | counter[8] | ciphertext | tag[16]
+//
+// The client sends init until it receives resp, both are authenticated by
+// the pre-shared key and, with static keys, by a static-static DH. Each init
+// is sealed with a key of its own, see initKey. The session keys are derived
+// from the ephemeral-ephemeral DH (plus both ephemeral-static DHs with static
+// keys) salted with the pre-shared key, so they cannot be recovered once the
+// ephemeral keys are gone.
+const (
+	kxInit = 1
+	kxResp = 2
+	kxData = 3
+
+	kxInitSize       = 1 + 8 + 32 + 32 + aeadTagSize
+	kxRespSize       = 1 + 8 + 32 + aeadTagSize
+	kxDataHeaderSize = 1 + 8 + 8
+
+	// kxRetransmit is how often a client resends its init while waiting
+	kxRetransmit = 500 * time.Millisecond
+
+	// kxMaxSessions bounds the sessions kept by a server
+	kxMaxSessions = 65536
+
+	// kxLinger is how long a server keeps the keys of a session once it is
+	// forgotten, kcp-go still sends the last flush of a closed session
+	kxLinger = time.Second
+)
+
+var (
+	// ErrKeyExchange is returned by the client constructors when the server
+	// does not answer the key exchange in time
+	ErrKeyExchange = errors.New("xkcp: key exchange failed")
+
+	errKXNoSession = errors.New("xkcp: no key exchange session for address")
+)
+
+// GenerateKeyPair returns a new hex encoded static X25519 key pair for KeyExchangeConf
+func GenerateKeyPair() (privateKey, publicKey string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(key.Bytes()), hex.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// static reports whether the exchange is authenticated by static keys
+func (kx *KeyExchangeConf) static() bool {
+	return kx != nil && kx.PrivateKey != ""
+}
+
+// kxKeys holds the long term secrets of one side of the key exchange
+type kxKeys struct {
+	crypt  string
+	psk    []byte
+	static *ecdh.PrivateKey // nil without static keys
+	peers  [][]byte         // accepted static public keys of the other side
+}
+
+func newKXKeys(conf *KcpConfig, psk []byte) (*kxKeys, error) {
+	keys := &kxKeys{crypt: conf.Crypt, psk: psk}
+
+	kx := conf.KeyExchangeConf
+	if !kx.static() {
+		return keys, nil
+	}
+
+	priv, err := decodeKey(kx.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if keys.static, err = ecdh.X25519().NewPrivateKey(priv); err != nil {
+		return nil, err
+	}
+
+	for _, peer := range kx.PeerKeys {
+		pub, err := decodeKey(peer)
+		if err != nil {
+			return nil, err
+		}
+		keys.peers = append(keys.peers, pub)
+	}
+
+	return keys, nil
+}
+
+// initKey derives the key of an init packet, staticDH is the static-static
+// DH or nil. The session id and the client ephemeral key of the init salt
+// it, so that every init gets its own key: they are sealed with a zero
+// nonce, which must never be used twice under the same key.
+func (k *kxKeys) initKey(staticDH, init []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, append(slices.Clone(k.psk), staticDH...), init[1:41], "xkcp kx init", 32)
+}
+
+// initCipher returns the AEAD authenticating init, see initKey
+func (k *kxKeys) initCipher(staticDH, init []byte) (cipher.AEAD, error) {
+	key, err := k.initKey(staticDH, init)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAEADCipher(k.crypt, key)
+}
+
+// sessionCiphers derives the resp, client to server and server to client
+// AEADs from the DH results and the handshake transcript
+func (k *kxKeys) sessionCiphers(ikm, transcript []byte) (resp, c2s, s2c cipher.AEAD, err error) {
+	okm, err := hkdf.Key(sha256.New, ikm, k.psk, "xkcp kx session "+string(transcript), 96)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if resp, err = newAEADCipher(k.crypt, okm[:32]); err != nil {
+		return nil, nil, nil, err
+	}
+	if c2s, err = newAEADCipher(k.crypt, okm[32:64]); err != nil {
+		return nil, nil, nil, err
+	}
+	if s2c, err = newAEADCipher(k.crypt, okm[64:]); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return resp, c2s, s2c, nil
+}
+
+// dh runs X25519 between priv and the raw public key pub
+func dh(priv *ecdh.PrivateKey, pub []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return priv.ECDH(key)
+}
+
+// kxSeal appends the data packet for p to dst
+func kxSeal(dst []byte, aead cipher.AEAD, id [8]byte, counter uint64, p []byte) []byte {
+	dst = append(dst, kxData)
+	dst = append(dst, id[:]...)
+	dst = binary.BigEndian.AppendUint64(dst, counter)
+
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return aead.Seal(dst, nonce[:], p, dst[:kxDataHeaderSize])
+}
+
+// kxOpen decrypts the data packet pkt in place, window must be locked by the caller
+func kxOpen(pkt []byte, aead cipher.AEAD, window *replayWindow) ([]byte, bool) {
+	counter := binary.BigEndian.Uint64(pkt[9:kxDataHeaderSize])
+	if !window.fresh(counter) {
+		return nil, false
+	}
+
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	plain, err := aead.Open(pkt[kxDataHeaderSize:kxDataHeaderSize], nonce[:], pkt[kxDataHeaderSize:], pkt[:kxDataHeaderSize])
+	if err != nil {
+		return nil, false
+	}
+
+	window.mark(counter)
+	return plain, true
+}
+
+// kxClientConn is the client side of the key exchange, it carries a single
+// session to one server
+type kxClientConn struct {
+	socketOptions
+
+	id   [8]byte
+	seal cipher.AEAD
+	open cipher.AEAD
+
+	sendMu  sync.Mutex
+	counter uint64
+
+	mu     sync.Mutex
+	window replayWindow
+
+	bufs sync.Pool
+}
+
+// newKXClientConn runs the key exchange with the server at remote over conn
+func newKXClientConn(ctx context.Context, conn net.PacketConn, remote net.Addr, keys *kxKeys) (*kxClientConn, error) {
+	c := &kxClientConn{
+		socketOptions: socketOptions{conn},
+		bufs:          newPacketPool(),
+	}
+
+	if _, err := rand.Read(c.id[:]); err != nil {
+		return nil, err
+	}
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var staticDH, static []byte
+	if keys.static != nil {
+		if len(keys.peers) != 1 {
+			return nil, &ConfigError{Field: "KeyExchangeConf.PeerKeys", Reason: "must hold exactly the server key on a client"}
+		}
+
+		if staticDH, err = dh(keys.static, keys.peers[0]); err != nil {
+			return nil, err
+		}
+		static = keys.static.PublicKey().Bytes()
+	}
+
+	init := make([]byte, 0, kxInitSize)
+	init = append(init, kxInit)
+	init = append(init, c.id[:]...)
+	init = append(init, eph.PublicKey().Bytes()...)
+	init = append(init, make([]byte, 32)...)
+	copy(init[41:73], static)
+
+	initCipher, err := keys.initCipher(staticDH, init)
+	if err != nil {
+		return nil, err
+	}
+	init = initCipher.Seal(init, make([]byte, initCipher.NonceSize()), nil, init)
+
+	// the reads below need deadlines, leave conn without one afterwards
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, aeadBufferSize)
+	for {
+		if _, err := conn.WriteTo(init, remote); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(kxRetransmit)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+
+		for time.Now().Before(deadline) {
+			if err := ctx.Err(); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrKeyExchange, err)
+			}
+
+			conn.SetReadDeadline(deadline)
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+
+			resp := buf[:n]
+			if n != kxRespSize || resp[0] != kxResp || !bytes.Equal(resp[1:9], c.id[:]) {
+				continue
+			}
+
+			if c.finish(keys, eph, init, resp, staticDH) {
+				return c, nil
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrKeyExchange, err)
+		}
+	}
+}
+
+// finish derives the session keys from resp and reports whether it is authentic
+func (c *kxClientConn) finish(keys *kxKeys, eph *ecdh.PrivateKey, init, resp []byte, staticDH []byte) bool {
+	serverEph := resp[9:41]
+
+	ikm, err := dh(eph, serverEph)
+	if err != nil {
+		return false
+	}
+
+	if staticDH != nil {
+		es, err := dh(eph, keys.peers[0])
+		if err != nil {
+			return false
+		}
+
+		se, err := dh(keys.static, serverEph)
+		if err != nil {
+			return false
+		}
+		ikm = append(append(ikm, es...), se...)
+	}
+
+	respCipher, c2s, s2c, err := keys.sessionCiphers(ikm, append(slices.Clone(init), serverEph...))
+	if err != nil {
+		return false
+	}
+
+	if _, err := respCipher.Open(nil, make([]byte, respCipher.NonceSize()), resp[41:], resp[:41]); err != nil {
+		return false
+	}
+
+	c.seal, c.open = c2s, s2c
+	return true
+}
+
+// WriteTo seals p for the server, it reports len(p) on success
+func (c *kxClientConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	bp := c.bufs.Get().(*[]byte)
+	defer c.bufs.Put(bp)
+
+	c.sendMu.Lock()
+	counter := c.counter
+	c.counter++
+	c.sendMu.Unlock()
+
+	pkt := kxSeal((*bp)[:0], c.seal, c.id, counter, p)
+	if _, err := c.PacketConn.WriteTo(pkt, addr); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// ReadFrom returns the next authentic datagram of the session, silently
+// dropping the others
+func (c *kxClientConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	bp := c.bufs.Get().(*[]byte)
+	defer c.bufs.Put(bp)
+	buf := *bp
+
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+
+		pkt := buf[:n]
+		if n < kxDataHeaderSize+aeadTagSize || pkt[0] != kxData || !bytes.Equal(pkt[1:9], c.id[:]) {
+			continue
+		}
+
+		c.mu.Lock()
+		plain, ok := kxOpen(pkt, c.open, &c.window)
+		c.mu.Unlock()
+
+		if ok {
+			return copy(p, plain), addr, nil
+		}
+	}
+}
+
+// kxSession is the server state of one exchanged session
+type kxSession struct {
+	id       [8]byte
+	addr     string
+	initEph  []byte // ephemeral key of the init, to recognize retransmits
+	resp     []byte // resp packet, sent again for retransmitted inits
+	seal     cipher.AEAD
+	open     cipher.AEAD
+	counter  uint64
+	window   replayWindow
+	lastSeen time.Time
+}
+
+// kxServerConn is the server side of the key exchange, it answers inits and
+// keeps the keys of every session until it is forgotten, idle or evicted
+type kxServerConn struct {
+	socketOptions
+
+	keys *kxKeys
+	idle time.Duration // sessions quiet for longer are swept, zero keeps them
+
+	mu        sync.Mutex
+	sessions  map[[8]byte]*kxSession
+	byAddr    map[string]*kxSession
+	lastSweep time.Time
+
+	bufs sync.Pool
+}
+
+func newKXServerConn(conn net.PacketConn, keys *kxKeys, idle time.Duration) *kxServerConn {
+	return &kxServerConn{
+		socketOptions: socketOptions{conn},
+		keys:          keys,
+		idle:          idle,
+		sessions:      make(map[[8]byte]*kxSession),
+		byAddr:        make(map[string]*kxSession),
+		lastSweep:     time.Now(),
+		bufs:          newPacketPool(),
+	}
+}
+
+// WriteTo seals p with the keys of the latest session from addr
+func (c *kxServerConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	sess, ok := c.byAddr[addr.String()]
+	if !ok {
+		c.mu.Unlock()
+		return 0, errKXNoSession
+	}
+	counter := sess.counter
+	sess.counter++
+	c.mu.Unlock()
+
+	bp := c.bufs.Get().(*[]byte)
+	defer c.bufs.Put(bp)
+
+	pkt := kxSeal((*bp)[:0], sess.seal, sess.id, counter, p)
+	if _, err := c.PacketConn.WriteTo(pkt, addr); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// ReadFrom answers key exchanges and returns the next authentic datagram of
+// an exchanged session, silently dropping the others
+func (c *kxServerConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	bp := c.bufs.Get().(*[]byte)
+	defer c.bufs.Put(bp)
+	buf := *bp
+
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+
+		pkt := buf[:n]
+		switch {
+		case n == kxInitSize && pkt[0] == kxInit:
+			c.accept(pkt, addr)
+		case n >= kxDataHeaderSize+aeadTagSize && pkt[0] == kxData:
+			if plain, ok := c.open(pkt, addr); ok {
+				return copy(p, plain), addr, nil
+			}
+		}
+	}
+}
+
+// open decrypts a data packet of a known session in place
+func (c *kxServerConn) open(pkt []byte, addr net.Addr) ([]byte, bool) {
+	var id [8]byte
+	copy(id[:], pkt[1:9])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sess, ok := c.sessions[id]
+	if !ok {
+		return nil, false
+	}
+
+	plain, ok := kxOpen(pkt, sess.open, &sess.window)
+	if !ok {
+		return nil, false
+	}
+
+	sess.lastSeen = time.Now()
+	if a := addr.String(); a != sess.addr {
+		// the client moved, follow it
+		if c.byAddr[sess.addr] == sess {
+			delete(c.byAddr, sess.addr)
+		}
+		sess.addr = a
+		c.byAddr[a] = sess
+	}
+
+	return plain, true
+}
+
+// accept answers an init packet, creating the session on the first one
+func (c *kxServerConn) accept(init []byte, addr net.Addr) {
+	var id [8]byte
+	copy(id[:], init[1:9])
+	clientEph, clientStatic := init[9:41], init[41:73]
+
+	c.mu.Lock()
+	if sess, ok := c.sessions[id]; ok && bytes.Equal(sess.initEph, clientEph) {
+		// our resp got lost
+		resp := sess.resp
+		c.mu.Unlock()
+		c.PacketConn.WriteTo(resp, addr)
+		return
+	}
+	c.mu.Unlock()
+
+	var staticDH []byte
+	if c.keys.static != nil {
+		if !slices.ContainsFunc(c.keys.peers, func(peer []byte) bool { return bytes.Equal(peer, clientStatic) }) {
+			return
+		}
+
+		var err error
+		if staticDH, err = dh(c.keys.static, clientStatic); err != nil {
+			return
+		}
+	}
+
+	initCipher, err := c.keys.initCipher(staticDH, init)
+	if err != nil {
+		return
+	}
+
+	if _, err := initCipher.Open(nil, make([]byte, initCipher.NonceSize()), init[73:], init[:73]); err != nil {
+		return
+	}
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+
+	ikm, err := dh(eph, clientEph)
+	if err != nil {
+		return
+	}
+
+	if staticDH != nil {
+		es, err := dh(c.keys.static, clientEph)
+		if err != nil {
+			return
+		}
+
+		se, err := dh(eph, clientStatic)
+		if err != nil {
+			return
+		}
+		ikm = append(append(ikm, es...), se...)
+	}
+
+	serverEph := eph.PublicKey().Bytes()
+	respCipher, c2s, s2c, err := c.keys.sessionCiphers(ikm, append(slices.Clone(init), serverEph...))
+	if err != nil {
+		return
+	}
+
+	resp := make([]byte, 0, kxRespSize)
+	resp = append(resp, kxResp)
+	resp = append(resp, id[:]...)
+	resp = append(resp, serverEph...)
+	resp = respCipher.Seal(resp, make([]byte, respCipher.NonceSize()), nil, resp)
+
+	sess := &kxSession{
+		id:       id,
+		addr:     addr.String(),
+		initEph:  slices.Clone(clientEph),
+		resp:     resp,
+		seal:     s2c,
+		open:     c2s,
+		lastSeen: time.Now(),
+	}
+
+	c.mu.Lock()
+	c.addSession(sess, sess.lastSeen)
+	c.mu.Unlock()
+
+	c.PacketConn.WriteTo(resp, addr)
+}
+
+// addSession stores a new session in place of the previous one of its
+// address, which kcp-go replaces too. Idle sessions are swept from time to
+// time, the least recently seen one is evicted when still full. c.mu must be
+// held.
+func (c *kxServerConn) addSession(sess *kxSession, now time.Time) {
+	if old, ok := c.sessions[sess.id]; ok {
+		c.removeSession(old)
+	}
+	if old, ok := c.byAddr[sess.addr]; ok {
+		c.removeSession(old)
+	}
+
+	if c.idle > 0 && now.Sub(c.lastSweep) >= c.idle/2 {
+		c.sweep(now)
+	}
+
+	if len(c.sessions) >= kxMaxSessions {
+		var oldest *kxSession
+		for _, s := range c.sessions {
+			if oldest == nil || s.lastSeen.Before(oldest.lastSeen) {
+				oldest = s
+			}
+		}
+		c.removeSession(oldest)
+	}
+
+	c.sessions[sess.id] = sess
+	c.byAddr[sess.addr] = sess
+}
+
+// removeSession forgets sess. c.mu must be held.
+func (c *kxServerConn) removeSession(sess *kxSession) {
+	delete(c.sessions, sess.id)
+	if c.byAddr[sess.addr] == sess {
+		delete(c.byAddr, sess.addr)
+	}
+}
+
+// sweep forgets the sessions that have been quiet for longer than c.idle,
+// their kcp sessions are closed by then. c.mu must be held.
+func (c *kxServerConn) sweep(now time.Time) {
+	for _, sess := range c.sessions {
+		if now.Sub(sess.lastSeen) > c.idle {
+			c.removeSession(sess)
+		}
+	}
+	c.lastSweep = now
+}
+
+// forget drops the keys of the session of addr after kxLinger, once its kcp
+// session is gone. A later session of the same address is kept.
+func (c *kxServerConn) forget(addr net.Addr) {
+	c.mu.Lock()
+	sess, ok := c.byAddr[addr.String()]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	time.AfterFunc(kxLinger, func() {
+		c.mu.Lock()
+		if c.sessions[sess.id] == sess {
+			c.removeSession(sess)
+		}
+		c.mu.Unlock()
+	})
+}
@@ -0,0 +1,326 @@
+package xkcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testKXEcho checks that a client dialed with conf gets its data echoed
+func testKXEcho(t *testing.T, saddr string, conf *KcpConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialContext(ctx, saddr, conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+}
+
+func TestKeyExchange_PSK(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.Crypt = CryptAESGCM
+	conf.KeyExchangeConf = &KeyExchangeConf{}
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	testKXEcho(t, saddr, conf)
+	testKXEcho(t, saddr, conf)
+
+	wrong := DefaultConfig()
+	wrong.Handshake = true
+	wrong.Crypt = CryptAESGCM
+	wrong.KeyExchangeConf = &KeyExchangeConf{}
+	wrong.Seed = "not the server seed"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	_, err = DialContext(ctx, saddr, wrong)
+	require.True(t, errors.Is(err, ErrKeyExchange), "unexpected error: %v", err)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+}
+
+func TestKeyExchange_StaticKeys(t *testing.T) {
+	serverPriv, serverPub, err := GenerateKeyPair()
+	require.NoError(t, err)
+	clientPriv, clientPub, err := GenerateKeyPair()
+	require.NoError(t, err)
+	otherPriv, _, err := GenerateKeyPair()
+	require.NoError(t, err)
+
+	serverConf := DefaultConfig()
+	serverConf.Handshake = true
+	serverConf.Crypt, serverConf.Seed = CryptChaCha20Poly1305, ""
+	serverConf.KeyExchangeConf = &KeyExchangeConf{PrivateKey: serverPriv, PeerKeys: []string{clientPub}}
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, serverConf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	clientConf := DefaultConfig()
+	clientConf.Handshake = true
+	clientConf.Crypt, clientConf.Seed = CryptChaCha20Poly1305, ""
+	clientConf.KeyExchangeConf = &KeyExchangeConf{PrivateKey: clientPriv, PeerKeys: []string{serverPub}}
+	testKXEcho(t, saddr, clientConf)
+
+	// a client key the server does not know
+	stranger := DefaultConfig()
+	stranger.Handshake = true
+	stranger.Crypt, stranger.Seed = CryptChaCha20Poly1305, ""
+	stranger.KeyExchangeConf = &KeyExchangeConf{PrivateKey: otherPriv, PeerKeys: []string{serverPub}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	_, err = DialContext(ctx, saddr, stranger)
+	require.True(t, errors.Is(err, ErrKeyExchange), "unexpected error: %v", err)
+}
+
+func TestKeyExchange_WithConn(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Crypt = CryptAESGCM
+	conf.KeyExchangeConf = &KeyExchangeConf{}
+
+	sconn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+
+	server, err := NewServerWithConn(sconn, conf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	cconn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+
+	client, err := NewClientWithConn(cconn, sconn.LocalAddr(), conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+}
+
+func TestKeyExchange_ClientConfig(t *testing.T) {
+	_, pub1, err := GenerateKeyPair()
+	require.NoError(t, err)
+	priv, pub2, err := GenerateKeyPair()
+	require.NoError(t, err)
+
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.Crypt = CryptAESGCM
+	conf.KeyExchangeConf = &KeyExchangeConf{PrivateKey: priv, PeerKeys: []string{pub1, pub2}}
+
+	_, err = DialContext(context.Background(), getTestAddr(), conf)
+	var ce *ConfigError
+	require.True(t, errors.As(err, &ce), "unexpected error: %v", err)
+	require.Equal(t, "KeyExchangeConf.PeerKeys", ce.Field)
+}
+
+// testKXPair returns the two ends of a key exchange over loopback sockets
+func testKXPair(t *testing.T) (*kxClientConn, *kxServerConn) {
+	conf := DefaultConfig()
+	conf.Crypt = CryptAESGCM
+	conf.KeyExchangeConf = &KeyExchangeConf{}
+
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+
+	keys, err := newKXKeys(conf, legacyKey(conf.Seed))
+	require.NoError(t, err)
+
+	server := newKXServerConn(b, keys, 0)
+
+	// answer the first init only, the tests read the socket themselves
+	go func() {
+		buf := make([]byte, 1500)
+		n, addr, err := b.ReadFrom(buf)
+		if err == nil {
+			server.accept(buf[:n], addr)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := newKXClientConn(ctx, a, b.LocalAddr(), keys)
+	require.NoError(t, err)
+
+	return client, server
+}
+
+func TestKeyExchange_Packets(t *testing.T) {
+	client, server := testKXPair(t)
+
+	_, err := client.WriteTo([]byte("ping"), server.LocalAddr())
+	require.NoError(t, err)
+
+	raw := make([]byte, 1500)
+	server.PacketConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := server.PacketConn.ReadFrom(raw)
+	require.NoError(t, err)
+	pkt := raw[:n]
+
+	plain, ok := server.open(append([]byte(nil), pkt...), addr)
+	require.True(t, ok)
+	require.Equal(t, "ping", string(plain))
+
+	_, ok = server.open(append([]byte(nil), pkt...), addr)
+	require.False(t, ok, "replayed packet accepted")
+
+	tampered := append([]byte(nil), pkt...)
+	tampered[len(tampered)-1] ^= 1
+	_, ok = server.open(tampered, addr)
+	require.False(t, ok, "tampered packet accepted")
+
+	// a second session gets its own keys
+	other, _ := testKXPair(t)
+	require.NotEqual(t, client.id, other.id)
+
+	forged := kxSeal(nil, other.seal, client.id, 100, []byte("ping"))
+	_, ok = server.open(forged, addr)
+	require.False(t, ok, "packet sealed with another session key accepted")
+
+	_, err = server.WriteTo([]byte("pong"), addr)
+	require.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err = client.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(buf[:n]))
+
+	_, err = server.WriteTo([]byte("pong"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	require.True(t, errors.Is(err, errKXNoSession), "unexpected error: %v", err)
+}
+
+func TestKeyExchange_RetransmittedInit(t *testing.T) {
+	_, server := testKXPair(t)
+
+	server.mu.Lock()
+	require.Len(t, server.sessions, 1)
+	var sess *kxSession
+	for _, s := range server.sessions {
+		sess = s
+	}
+	server.mu.Unlock()
+
+	// a retransmitted init must not rekey the session
+	init := make([]byte, kxInitSize)
+	init[0] = kxInit
+	copy(init[1:9], sess.id[:])
+	copy(init[9:41], sess.initEph)
+
+	addr, err := net.ResolveUDPAddr("udp", sess.addr)
+	require.NoError(t, err)
+	server.accept(init, addr)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	require.Same(t, sess, server.sessions[sess.id])
+}
+
+func TestKeyExchange_ForgetClosedSession(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.Crypt = CryptAESGCM
+	conf.KeyExchangeConf = &KeyExchangeConf{}
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testOnceEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	testKXEcho(t, saddr, conf)
+
+	// the handler returned, the keys of its session must go with it
+	require.Eventually(t, func() bool {
+		server.kx.mu.Lock()
+		defer server.kx.mu.Unlock()
+		return len(server.kx.sessions) == 0 && len(server.kx.byAddr) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestKeyExchange_Sweep(t *testing.T) {
+	_, server := testKXPair(t)
+	server.idle = time.Minute
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	var quiet *kxSession
+	for _, s := range server.sessions {
+		quiet = s
+	}
+	now := time.Now()
+	quiet.lastSeen = now.Add(-2 * time.Minute)
+
+	fresh := &kxSession{id: [8]byte{1}, addr: "127.0.0.1:9", lastSeen: now}
+	server.addSession(fresh, now.Add(time.Minute))
+	require.NotContains(t, server.sessions, quiet.id)
+	require.NotContains(t, server.byAddr, quiet.addr)
+	require.Same(t, fresh, server.sessions[fresh.id])
+
+	// a new exchange from an address replaces the session of that address
+	next := &kxSession{id: [8]byte{2}, addr: fresh.addr, lastSeen: now}
+	server.addSession(next, now)
+	require.NotContains(t, server.sessions, fresh.id)
+	require.Same(t, next, server.byAddr[next.addr])
+}
+
+func TestKeyExchange_InitKeys(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Crypt = CryptAESGCM
+	conf.KeyExchangeConf = &KeyExchangeConf{}
+	keys, err := newKXKeys(conf, legacyKey(conf.Seed))
+	require.NoError(t, err)
+
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer sink.Close()
+
+	// capture the inits of two clients sharing the pre-shared key
+	var inits [][]byte
+	for range 2 {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		go newKXClientConn(ctx, conn, sink.LocalAddr(), keys)
+
+		buf := make([]byte, 1500)
+		sink.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := sink.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, kxInitSize, n)
+		inits = append(inits, buf[:n])
+	}
+
+	// both are sealed with a zero nonce, under keys of their own
+	first, err := keys.initKey(nil, inits[0])
+	require.NoError(t, err)
+	second, err := keys.initKey(nil, inits[1])
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+
+	initCipher, err := keys.initCipher(nil, inits[0])
+	require.NoError(t, err)
+	_, err = initCipher.Open(nil, make([]byte, initCipher.NonceSize()), inits[1][73:], inits[1][:73])
+	require.Error(t, err)
+}
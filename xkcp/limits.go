@@ -0,0 +1,111 @@
+package xkcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// Reasons a Server rejects a session for, as logged and counted in
+// MetricsSnapshot.Rejected
+const (
+	RejectMaxSessions      = "max_sessions"
+	RejectMaxSessionsPerIP = "max_sessions_per_ip"
+	RejectRate             = "rate"
+	RejectPoolFull         = "pool_full" // see PoolFullReject
+)
+
+// RejectReasons lists the reasons counted in MetricsSnapshot.Rejected
+var RejectReasons = []string{RejectMaxSessions, RejectMaxSessionsPerIP, RejectRate, RejectPoolFull}
+
+// acceptRate is a token bucket of new sessions, it is only used by the
+// accept loop
+type acceptRate struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow reports whether a new session fits in perSecond, zero is unlimited
+func (r *acceptRate) allow(perSecond int, now time.Time) bool {
+	if perSecond <= 0 {
+		return true
+	}
+
+	rate := float64(perSecond)
+	if r.last.IsZero() {
+		r.tokens = rate
+	} else {
+		r.tokens = min(rate, r.tokens+now.Sub(r.last).Seconds()*rate)
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+
+	r.tokens--
+	return true
+}
+
+// addrIP returns the IP of addr, or addr itself when it has no port
+func addrIP(addr net.Addr) string {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admit returns why a session just accepted by loop is over limits, or an
+// empty string. Sessions are only added by loop, so the counts cannot grow
+// before the session is tracked.
+func (s *Server) admit(conn *kcp.UDPSession, limits *LimitConf) string {
+	if limits == nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	total := len(s.sessions)
+	fromIP := s.perIP[addrIP(conn.RemoteAddr())]
+	s.mu.Unlock()
+
+	switch {
+	case limits.MaxSessions > 0 && total >= limits.MaxSessions:
+		return RejectMaxSessions
+	case limits.MaxSessionsPerIP > 0 && fromIP >= limits.MaxSessionsPerIP:
+		return RejectMaxSessionsPerIP
+	case !s.rate.allow(limits.MaxNewPerSecond, time.Now()):
+		// checked last, sessions rejected by the caps take no token
+		return RejectRate
+	}
+
+	return ""
+}
+
+// reject closes a session over the limits of conf or turned away by a full
+// pool, answering it first when LimitConf asks for a refusal
+func (s *Server) reject(conn *kcp.UDPSession, reason string, conf *KcpConfig) {
+	s.metrics.addRejected(reason)
+	s.logger.Debug("xkcp: session rejected", "remote", conn.RemoteAddr(), "conv", conn.GetConv(), "reason", reason)
+
+	if conf.LimitConf != nil && conf.LimitConf.Refuse {
+		// an untuned session has no congestion window to send with. The
+		// refusal is best effort, it is not retransmitted once closed.
+		tuneSession(conn, conf)
+		_ = writeFrame(conn, frameRefused, []byte(reason))
+	}
+	conn.Close()
+
+	if s.cookie != nil {
+		s.cookie.forget(conn.RemoteAddr())
+	}
+	if s.kx != nil {
+		s.kx.forget(conn.RemoteAddr())
+	}
+	s.hooks.OnReject(conn, reason, nil)
+}
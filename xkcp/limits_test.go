@@ -0,0 +1,135 @@
+package xkcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testLimitsDial dials saddr and waits for the handshake at most timeout
+func testLimitsDial(t *testing.T, saddr string, timeout time.Duration) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client, err := Dial(ctx, saddr)
+	if err == nil {
+		t.Cleanup(func() { client.Close() })
+	}
+	return client, err
+}
+
+func TestAcceptRate(t *testing.T) {
+	var r acceptRate
+	now := time.Now()
+
+	require.True(t, r.allow(0, now))
+
+	// bursts of perSecond, then refills over time
+	for i := 0; i < 3; i++ {
+		require.True(t, r.allow(3, now))
+	}
+	require.False(t, r.allow(3, now))
+	require.False(t, r.allow(3, now.Add(100*time.Millisecond)))
+	require.True(t, r.allow(3, now.Add(400*time.Millisecond)))
+	require.False(t, r.allow(3, now.Add(400*time.Millisecond)))
+}
+
+func TestAddrIP(t *testing.T) {
+	require.Equal(t, "127.0.0.1", addrIP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}))
+	require.Equal(t, "::1", addrIP(&net.UDPAddr{IP: net.IPv6loopback, Port: 4000}))
+	require.Equal(t, "10.0.0.1", addrIP(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}))
+}
+
+func TestServer_LimitSessions(t *testing.T) {
+	metrics := NewMetrics()
+
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.LimitConf = &LimitConf{MaxSessions: 2, Refuse: true}
+	server, err := StartServer(saddr, WithConfig(conf),
+		WithHandler(&testEchoHandler{}), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		client, err := testLimitsDial(t, saddr, 5*time.Second)
+		require.NoError(t, err)
+		testEcho(t, client)
+	}
+
+	_, err = testLimitsDial(t, saddr, 5*time.Second)
+	require.True(t, errors.Is(err, ErrRefused), "unexpected error: %v", err)
+	require.Contains(t, err.Error(), RejectMaxSessions)
+
+	snap := metrics.Snapshot()
+	require.EqualValues(t, 2, snap.Accepted)
+	require.EqualValues(t, 1, snap.Rejected[RejectMaxSessions])
+	require.Zero(t, snap.Rejected[RejectRate])
+}
+
+func TestServer_LimitSessionsPerIP(t *testing.T) {
+	metrics := NewMetrics()
+
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.LimitConf = &LimitConf{MaxSessionsPerIP: 1, Refuse: true}
+	server, err := StartServer(saddr, WithConfig(conf),
+		WithHandler(&testEchoHandler{}), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, client)
+
+	_, err = testLimitsDial(t, saddr, 5*time.Second)
+	require.True(t, errors.Is(err, ErrRefused), "unexpected error: %v", err)
+	require.EqualValues(t, 1, metrics.Snapshot().Rejected[RejectMaxSessionsPerIP])
+
+	// the slot is given back once the session is gone. The last packets of
+	// the client may reopen it on the server, until they are all in.
+	client.Close()
+	require.Eventually(t, func() bool {
+		server.closeSessions()
+		return testSessionCount(server) == 0
+	}, 2*time.Second, 50*time.Millisecond)
+
+	client, err = testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, client)
+}
+
+func TestServer_LimitRate(t *testing.T) {
+	metrics := NewMetrics()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.LimitConf = &LimitConf{MaxNewPerSecond: 1}
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithConfig(conf), WithHandler(&testEchoHandler{}), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer server.Close()
+
+	_, err = testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+
+	// without Refuse the dial only times out
+	_, err = testLimitsDial(t, saddr, 300*time.Millisecond)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+	require.NotZero(t, metrics.Snapshot().Rejected[RejectRate])
+
+	// limits can be lifted on a running server
+	lifted := DefaultConfig()
+	lifted.Handshake = true
+	require.NoError(t, server.UpdateConfig(lifted, false))
+
+	client, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, client)
+}
@@ -0,0 +1,482 @@
+package xkcp
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// acceptBacklog is how many handshaken connections may wait for Accept
+const acceptBacklog = 128
+
+// Listener is a net.Listener serving xkcp sessions, so that code written for
+// net.Listener (http.Server, grpc.Server, ...) can run over KCP. Sessions get
+// the same tuning and handshake as in Server. When MuxConf is set, every
+// stream opened by a multiplexing client is returned by Accept on its own.
+// KeepAlive and IdleTimeout apply as in Server, reads and writes of an idle
+// session fail with ErrIdleTimeout.
+type Listener struct {
+	conf      *KcpConfig
+	lis       *kcp.Listener
+	rawConn   net.PacketConn
+	keepalive *keepaliveConn // nil unless trackPeers
+	auth      *serverAuth
+	logger    *slog.Logger
+
+	accepts chan net.Conn
+
+	mu    sync.Mutex
+	peers map[*listenerConn]*keepalivePeer // live sessions, when keepalive is set
+
+	die     chan struct{}
+	dieOnce sync.Once
+	err     error // reason the listener stopped, guarded by dieOnce
+}
+
+// NewListener creates a new xkcp listener on addr
+func NewListener(addr string, conf *KcpConfig) (*Listener, error) {
+	l, err := listen(addr, nil, conf, true, conf.logger(), DefaultMetrics)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newServerAuth(conf.AuthConf)
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+
+	return newListener(l.lis, l.rawConn, l.keepalive, conf, auth), nil
+}
+
+// NewListenerWithConn creates a new xkcp listener on a packet connection, conn is closed with the listener
+func NewListenerWithConn(conn net.PacketConn, conf *KcpConfig) (*Listener, error) {
+	l, err := listen("", conn, conf, false, conf.logger(), DefaultMetrics)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newServerAuth(conf.AuthConf)
+	if err != nil {
+		l.lis.Close()
+		return nil, err
+	}
+
+	return newListener(l.lis, conn, l.keepalive, conf, auth), nil
+}
+
+func newListener(lis *kcp.Listener, rawConn net.PacketConn, keepalive *keepaliveConn, conf *KcpConfig, auth *serverAuth) *Listener {
+	l := &Listener{
+		conf:      conf,
+		lis:       lis,
+		rawConn:   rawConn,
+		keepalive: keepalive,
+		auth:      auth,
+		logger:    conf.logger(),
+		accepts:   make(chan net.Conn, acceptBacklog),
+		peers:     make(map[*listenerConn]*keepalivePeer),
+		die:       make(chan struct{}),
+	}
+
+	l.logger.Info("xkcp: listening", "addr", lis.Addr(), "crypt", conf.Crypt,
+		"mux", conf.MuxConf != nil, "auth", auth != nil)
+
+	go l.loop()
+
+	if keepaliveEnabled(conf) {
+		go l.keepaliveLoop()
+	}
+
+	return l
+}
+
+// Accept waits for and returns the next session or stream
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepts:
+		return conn, nil
+	case <-l.die:
+		return nil, l.err
+	}
+}
+
+// Close stops listening and closes the underlying socket, which also ends
+// every session accepted from the listener
+func (l *Listener) Close() error {
+	l.shutdown(net.ErrClosed)
+	l.logger.Info("xkcp: listener closed", "addr", l.lis.Addr())
+
+	err := l.lis.Close()
+	if l.rawConn != nil {
+		l.rawConn.Close()
+	}
+
+	return err
+}
+
+// Addr returns the listener's network address
+func (l *Listener) Addr() net.Addr {
+	return l.lis.Addr()
+}
+
+func (l *Listener) shutdown(err error) {
+	l.dieOnce.Do(func() {
+		l.err = err
+		close(l.die)
+	})
+}
+
+func (l *Listener) loop() {
+	for {
+		conn, err := l.lis.AcceptKCP()
+		if err != nil {
+			if errors.Is(err, io.ErrClosedPipe) {
+				l.shutdown(net.ErrClosed)
+				return
+			}
+
+			// the socket is broken, surface it to Accept
+			l.logger.Error("xkcp: accept failed", "err", err)
+			l.shutdown(err)
+			return
+		}
+
+		tuneSession(conn, l.conf)
+		l.logger.Debug("xkcp: session accepted", "remote", conn.RemoteAddr(), "conv", conn.GetConv())
+
+		go l.handshake(l.track(conn))
+	}
+}
+
+// keepaliveLoop probes the quiet sessions and closes the idle ones until the
+// listener is closed
+func (l *Listener) keepaliveLoop() {
+	keepalive := time.Duration(l.conf.KeepAlive) * time.Millisecond
+	idle := time.Duration(l.conf.IdleTimeout) * time.Millisecond
+
+	ticker := time.NewTicker(keepaliveTick(l.conf))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.die:
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		peers := make(map[*listenerConn]*keepalivePeer, len(l.peers))
+		for conn, peer := range l.peers {
+			peers[conn] = peer
+		}
+		l.mu.Unlock()
+
+		for conn, peer := range peers {
+			if l.keepalive.check(conn.RemoteAddr(), peer, keepalive, idle) {
+				l.logger.Info("xkcp: session idle, closing", "remote", conn.RemoteAddr(), "conv", conn.GetConv(), "err", ErrIdleTimeout)
+				conn.idle.Store(true)
+				conn.Close()
+			}
+		}
+	}
+}
+
+// track wraps a session just accepted, recording its traffic when the
+// listener tracks peers
+func (l *Listener) track(session *kcp.UDPSession) *listenerConn {
+	conn := newListenerConn(l, session)
+	if l.keepalive == nil {
+		return conn
+	}
+
+	l.mu.Lock()
+	l.peers[conn] = l.keepalive.track(session.RemoteAddr())
+	l.mu.Unlock()
+
+	return conn
+}
+
+// untrack forgets a session once it is closed
+func (l *Listener) untrack(conn *listenerConn) {
+	if l.keepalive == nil {
+		return
+	}
+
+	l.mu.Lock()
+	peer := l.peers[conn]
+	delete(l.peers, conn)
+	l.mu.Unlock()
+
+	l.keepalive.untrack(conn.RemoteAddr(), peer)
+}
+
+// handshake completes the session preamble before the session reaches Accept
+func (l *Listener) handshake(conn *listenerConn) {
+	supported := byte(flagAckRequested)
+	if l.conf.MuxConf != nil {
+		supported |= flagMux
+	}
+
+	requested, id, err := serverHandshake(conn.UDPSession, l.conf.Handshake, supported, l.auth, nil)
+	if err != nil {
+		l.logger.Warn("xkcp: handshake failed", "remote", conn.RemoteAddr(), "conv", conn.GetConv(), "err", err)
+		conn.Close()
+		return
+	}
+
+	l.logger.Debug("xkcp: handshake completed", "remote", conn.RemoteAddr(), "conv", conn.GetConv(),
+		"mux", requested&flagMux != 0, "identity", id.String())
+
+	if requested&flagMux != 0 {
+		if supported&flagMux == 0 {
+			l.logger.Warn("xkcp: mux requested but not served", "remote", conn.RemoteAddr(), "conv", conn.GetConv())
+			conn.Close()
+			return
+		}
+
+		l.serveMux(conn, id)
+		return
+	}
+
+	l.deliver(withIdentity(conn, id))
+}
+
+// serveMux hands every stream of a multiplexed session to Accept
+func (l *Listener) serveMux(conn *listenerConn, id *Identity) {
+	sess, err := smux.Server(conn, l.conf.MuxConf.smuxConfig())
+	if err != nil {
+		l.logger.Error("xkcp: mux failed", "remote", conn.RemoteAddr(), "conv", conn.GetConv(), "err", err)
+		conn.Close()
+		return
+	}
+
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			sess.Close()
+			return
+		}
+
+		l.deliver(withIdentity(stream, id))
+	}
+}
+
+// withIdentity wraps conn so that it implements Authenticated, unless id is nil
+func withIdentity(conn net.Conn, id *Identity) net.Conn {
+	if id == nil {
+		return conn
+	}
+
+	return &authConn{Conn: conn, id: id}
+}
+
+// listenerConn is a session of a Listener, it is untracked once closed.
+//
+// net.Conn allows deadlines to change while a Read or Write is running, which
+// net/http does to abort the background read of a connection, but kcp-go
+// reads the deadlines of a session without its lock. listenerConn never sets
+// the read deadline of the session: it reads ahead in readLoop and times out
+// Read itself. The write deadline is set between Writes only, one changed
+// during a Write applies to the next.
+type listenerConn struct {
+	*kcp.UDPSession
+	l         *Listener
+	idle      atomic.Bool // closed by keepaliveLoop
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	readMu   sync.Mutex // held by Read
+	readOnce sync.Once  // starts readLoop
+	want     chan struct{}
+	reads    chan listenerRead
+	waiting  bool   // a read was asked of readLoop and not returned yet
+	pending  []byte // returned by readLoop and not yet by Read
+	readErr  error
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	readWake      chan struct{} // closed when readDeadline changes
+	writeDeadline time.Time
+
+	writeMu sync.Mutex // held by Write
+}
+
+// listenerRead is the result of one read of readLoop
+type listenerRead struct {
+	b   []byte
+	err error
+}
+
+// listenerReadSize is the buffer readLoop reads into
+const listenerReadSize = 32 << 10
+
+func newListenerConn(l *Listener, session *kcp.UDPSession) *listenerConn {
+	return &listenerConn{
+		UDPSession: session,
+		l:          l,
+		closed:     make(chan struct{}),
+		want:       make(chan struct{}, 1),
+		reads:      make(chan listenerRead, 1),
+		readWake:   make(chan struct{}),
+	}
+}
+
+// readLoop reads the session whenever Read asks for it, until an error
+func (c *listenerConn) readLoop() {
+	buf := make([]byte, listenerReadSize)
+	for {
+		select {
+		case <-c.want:
+		case <-c.closed:
+			return
+		}
+
+		n, err := c.UDPSession.Read(buf)
+		c.reads <- listenerRead{b: buf[:n], err: err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *listenerConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) == 0 && c.readErr == nil {
+		if err := c.awaitRead(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(c.pending) == 0 {
+		return 0, c.sessionErr(c.readErr)
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// awaitRead waits for readLoop to read, until the read deadline. c.readMu
+// must be held.
+func (c *listenerConn) awaitRead() error {
+	c.readOnce.Do(func() { go c.readLoop() })
+	if !c.waiting {
+		c.want <- struct{}{}
+		c.waiting = true
+	}
+
+	for {
+		c.deadlineMu.Lock()
+		deadline, wake := c.readDeadline, c.readWake
+		c.deadlineMu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case r := <-c.reads:
+			if timer != nil {
+				timer.Stop()
+			}
+			c.waiting = false
+			c.pending, c.readErr = r.b, r.err
+			return nil
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		case <-wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (c *listenerConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.applyWriteDeadline()
+	n, err := c.UDPSession.Write(b)
+	return n, c.sessionErr(err)
+}
+
+// applyWriteDeadline sets the write deadline of the session, c.writeMu must
+// be held
+func (c *listenerConn) applyWriteDeadline() {
+	c.deadlineMu.Lock()
+	deadline := c.writeDeadline
+	c.deadlineMu.Unlock()
+
+	c.UDPSession.SetWriteDeadline(deadline)
+}
+
+func (c *listenerConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *listenerConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	close(c.readWake)
+	c.readWake = make(chan struct{})
+	c.deadlineMu.Unlock()
+	return nil
+}
+
+func (c *listenerConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
+
+	// a running Write applies it on its next call
+	if c.writeMu.TryLock() {
+		c.applyWriteDeadline()
+		c.writeMu.Unlock()
+	}
+	return nil
+}
+
+// sessionErr returns ErrIdleTimeout in place of err when the listener closed
+// the session for being idle
+func (c *listenerConn) sessionErr(err error) error {
+	if err != nil && c.idle.Load() {
+		return ErrIdleTimeout
+	}
+	return err
+}
+
+func (c *listenerConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.l.untrack(c)
+	})
+	return c.UDPSession.Close()
+}
+
+// deliver queues conn for Accept, closing it if the listener is gone
+func (l *Listener) deliver(conn net.Conn) {
+	select {
+	case l.accepts <- conn:
+	case <-l.die:
+		conn.Close()
+	}
+}
@@ -0,0 +1,230 @@
+package xkcp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListener_HTTP(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	lis, err := NewListener(getTestAddr(), conf)
+	require.NoError(t, err)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello over kcp")
+	})}
+	go server.Serve(lis)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return DialContext(ctx, addr, conf)
+		},
+	}}
+
+	resp, err := client.Get("http://" + lis.Addr().String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hello over kcp", string(body))
+}
+
+func TestListener_Mux(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.MuxConf = DefaultMuxConf()
+
+	lis, err := NewListener(getTestAddr(), conf)
+	require.NoError(t, err)
+	defer lis.Close()
+
+	client, err := DialContext(context.Background(), lis.Addr().String(), conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		stream, err := client.OpenStream()
+		require.NoError(t, err)
+		defer stream.Close()
+
+		_, err = stream.Write([]byte("ping"))
+		require.NoError(t, err)
+
+		conn, err := lis.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(buf))
+	}
+}
+
+func TestListenerWithConn(t *testing.T) {
+	conn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+
+	lis, err := NewListenerWithConn(conn, DefaultConfig())
+	require.NoError(t, err)
+	defer lis.Close()
+
+	client, err := NewClient(lis.Addr().String(), DefaultConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	accepted, err := lis.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(accepted, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+func TestListener_Close(t *testing.T) {
+	lis, err := NewListener(getTestAddr(), DefaultConfig())
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := lis.Accept()
+		done <- err
+	}()
+
+	require.NoError(t, lis.Close())
+
+	select {
+	case err := <-done:
+		require.True(t, errors.Is(err, net.ErrClosed), "unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept did not return after Close")
+	}
+}
+
+func TestListener_Keepalive(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.KeepAlive = 100
+	conf.IdleTimeout = 500
+
+	lis, err := NewListener(getTestAddr(), conf)
+	require.NoError(t, err)
+	defer lis.Close()
+
+	go func() {
+		conn, err := lis.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialContext(ctx, lis.Addr().String(), conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the listener probes a quiet client, which stays open
+	testEcho(t, client)
+	time.Sleep(1500 * time.Millisecond)
+	testEcho(t, client)
+}
+
+func TestListener_IdleTimeout(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.IdleTimeout = 300
+
+	lis, err := NewListener(getTestAddr(), conf)
+	require.NoError(t, err)
+	defer lis.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the client neither probes nor times out
+	clientConf := DefaultConfig()
+	clientConf.Handshake = true
+	client, err := DialContext(ctx, lis.Addr().String(), clientConf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	conn, err := lis.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 16))
+	require.True(t, errors.Is(err, ErrIdleTimeout), "unexpected error: %v", err)
+
+	lis.mu.Lock()
+	defer lis.mu.Unlock()
+	require.Empty(t, lis.peers)
+}
+
+func TestListener_Deadlines(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	lis, err := NewListener(getTestAddr(), conf)
+	require.NoError(t, err)
+	defer lis.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialContext(ctx, lis.Addr().String(), conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	conn, err := lis.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// a deadline set while Read blocks, the way net/http aborts its
+	// background read, interrupts it
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 16))
+		read <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, conn.SetReadDeadline(time.Now()))
+
+	select {
+	case err := <-read:
+		require.True(t, errors.Is(err, os.ErrDeadlineExceeded), "unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read ignored the deadline")
+	}
+
+	// the data read meanwhile is not lost
+	require.NoError(t, conn.SetDeadline(time.Time{}))
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
@@ -0,0 +1,290 @@
+package xkcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variables read by the config loaders,
+// e.g. XKCP_MTU or XKCP_CRYPT.
+const EnvPrefix = "XKCP_"
+
+// LoadConfig reads a KcpConfig from a JSON (.json) or YAML (.yaml, .yml)
+// file. Fields missing from the file keep their DefaultConfig value, XKCP_*
+// environment variables override the file, and the result is validated.
+func LoadConfig(path string) (*KcpConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		return LoadConfigJSON(f)
+	case ".yaml", ".yml":
+		return LoadConfigYAML(f)
+	default:
+		return nil, fmt.Errorf("xkcp: unsupported config file extension %q", ext)
+	}
+}
+
+// LoadConfigJSON is like LoadConfig for JSON read from r
+func LoadConfigJSON(r io.Reader) (*KcpConfig, error) {
+	conf := DefaultConfig()
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(conf); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("xkcp: decode json config: %w", err)
+	}
+
+	return finishConfig(conf)
+}
+
+// LoadConfigYAML is like LoadConfig for YAML read from r
+func LoadConfigYAML(r io.Reader) (*KcpConfig, error) {
+	conf := DefaultConfig()
+
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(conf); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("xkcp: decode yaml config: %w", err)
+	}
+
+	return finishConfig(conf)
+}
+
+// LoadConfigEnv builds a KcpConfig from DefaultConfig and the XKCP_*
+// environment variables only.
+func LoadConfigEnv() (*KcpConfig, error) {
+	return finishConfig(DefaultConfig())
+}
+
+func finishConfig(conf *KcpConfig) (*KcpConfig, error) {
+	if err := applyEnv(conf, os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// envVars maps every supported variable, without EnvPrefix, to the field it
+// sets. XKCP_MODE comes first so that the individual mode variables refine it.
+var envVars = []struct {
+	name string
+	set  func(conf *KcpConfig, value string) error
+}{
+	{"SEED", func(c *KcpConfig, v string) error { c.Seed = v; return nil }},
+	{"CRYPT", func(c *KcpConfig, v string) error { c.Crypt = v; return nil }},
+	{"KEY", func(c *KcpConfig, v string) error { c.Key = v; return nil }},
+	{"KDF", func(c *KcpConfig, v string) error { kdfConf(c).Algorithm = v; return nil }},
+	{"KDF_SALT", func(c *KcpConfig, v string) error { kdfConf(c).Salt = v; return nil }},
+	{"MTU", envInt(func(c *KcpConfig) *int { return &c.MTU })},
+	{"SNDWND", envInt(func(c *KcpConfig) *int { return &c.SndWnd })},
+	{"RCVWND", envInt(func(c *KcpConfig) *int { return &c.RcvWnd })},
+	{"DSCP", envInt(func(c *KcpConfig) *int { return &c.DSCP })},
+	{"ACKNODELAY", func(c *KcpConfig, v string) (err error) { c.AckNodelay, err = strconv.ParseBool(v); return }},
+	{"SOCKBUF", envInt(func(c *KcpConfig) *int { return &c.SockBuf })},
+	{"MODE", func(c *KcpConfig, v string) (err error) { c.ModeConf, err = parseMode(v); return }},
+	{"NODELAY", envInt(func(c *KcpConfig) *int { return &modeConf(c).NoDelay })},
+	{"INTERVAL", envInt(func(c *KcpConfig) *int { return &modeConf(c).Interval })},
+	{"RESEND", envInt(func(c *KcpConfig) *int { return &modeConf(c).Resend })},
+	{"NC", envInt(func(c *KcpConfig) *int { return &modeConf(c).NoCongestion })},
+	{"DATASHARD", envInt(func(c *KcpConfig) *int { return &fecConf(c).DataShard })},
+	{"PARITYSHARD", envInt(func(c *KcpConfig) *int { return &fecConf(c).ParityShard })},
+	{"KEEPALIVE", envInt(func(c *KcpConfig) *int { return &c.KeepAlive })},
+	{"IDLETIMEOUT", envInt(func(c *KcpConfig) *int { return &c.IdleTimeout })},
+	{"MAXSESSIONS", envInt(func(c *KcpConfig) *int { return &limitConf(c).MaxSessions })},
+	{"MAXSESSIONSPERIP", envInt(func(c *KcpConfig) *int { return &limitConf(c).MaxSessionsPerIP })},
+	{"MAXNEWPERSECOND", envInt(func(c *KcpConfig) *int { return &limitConf(c).MaxNewPerSecond })},
+	{"REFUSE", func(c *KcpConfig, v string) (err error) { limitConf(c).Refuse, err = strconv.ParseBool(v); return }},
+	{"COOKIE_ALWAYS", func(c *KcpConfig, v string) (err error) { cookieConf(c).Always, err = strconv.ParseBool(v); return }},
+	{"COOKIE_THRESHOLD", envInt(func(c *KcpConfig) *int { return &cookieConf(c).Threshold })},
+	{"SENDRATE", envInt(func(c *KcpConfig) *int { return &rateConf(c).SendRate })},
+	{"RECVRATE", envInt(func(c *KcpConfig) *int { return &rateConf(c).RecvRate })},
+	{"GLOBAL_SENDRATE", envInt(func(c *KcpConfig) *int { return &rateConf(c).GlobalSendRate })},
+	{"GLOBAL_RECVRATE", envInt(func(c *KcpConfig) *int { return &rateConf(c).GlobalRecvRate })},
+	{"RATE_BURST", envInt(func(c *KcpConfig) *int { return &rateConf(c).Burst })},
+	{"POOL_WORKERS", envInt(func(c *KcpConfig) *int { return &poolConf(c).Workers })},
+	{"POOL_QUEUE", envInt(func(c *KcpConfig) *int { return &poolConf(c).Queue })},
+	{"POOL_FULL", func(c *KcpConfig, v string) error { poolConf(c).Full = v; return nil }},
+	{"HANDSHAKE", func(c *KcpConfig, v string) (err error) { c.Handshake, err = strconv.ParseBool(v); return }},
+	{"MUX", func(c *KcpConfig, v string) error {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+
+		if !enabled {
+			c.MuxConf = nil
+		} else if c.MuxConf == nil {
+			c.MuxConf = DefaultMuxConf()
+		}
+		return nil
+	}},
+}
+
+// applyEnv overlays the XKCP_* variables found through lookup onto conf
+func applyEnv(conf *KcpConfig, lookup func(string) (string, bool)) error {
+	for _, v := range envVars {
+		name := EnvPrefix + v.name
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		if err := v.set(conf, strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("xkcp: invalid %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func envInt(field func(*KcpConfig) *int) func(*KcpConfig, string) error {
+	return func(c *KcpConfig, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+
+		*field(c) = n
+		return nil
+	}
+}
+
+// modeConf returns c.ModeConf, allocating it from the normal preset when unset
+func modeConf(c *KcpConfig) *ModeConf {
+	if c.ModeConf == nil {
+		c.ModeConf = GetModeConf(ModeNormal)
+	}
+	return c.ModeConf
+}
+
+// fecConf returns c.FECConf, allocating an empty one when unset
+func fecConf(c *KcpConfig) *FECConf {
+	if c.FECConf == nil {
+		c.FECConf = &FECConf{}
+	}
+	return c.FECConf
+}
+
+// kdfConf returns c.KDFConf, allocating an empty one when unset
+func kdfConf(c *KcpConfig) *KDFConf {
+	if c.KDFConf == nil {
+		c.KDFConf = &KDFConf{}
+	}
+	return c.KDFConf
+}
+
+// limitConf returns c.LimitConf, allocating an unlimited one when unset
+func limitConf(c *KcpConfig) *LimitConf {
+	if c.LimitConf == nil {
+		c.LimitConf = &LimitConf{}
+	}
+	return c.LimitConf
+}
+
+// cookieConf returns c.CookieConf, allocating an empty one when unset
+func cookieConf(c *KcpConfig) *CookieConf {
+	if c.CookieConf == nil {
+		c.CookieConf = &CookieConf{}
+	}
+	return c.CookieConf
+}
+
+// poolConf returns c.PoolConf, allocating an empty one when unset
+func poolConf(c *KcpConfig) *PoolConf {
+	if c.PoolConf == nil {
+		c.PoolConf = &PoolConf{}
+	}
+	return c.PoolConf
+}
+
+// rateConf returns c.RateConf, allocating an unlimited one when unset
+func rateConf(c *KcpConfig) *RateConf {
+	if c.RateConf == nil {
+		c.RateConf = &RateConf{}
+	}
+	return c.RateConf
+}
+
+// parseMode resolves a mode preset name, unlike GetModeConf it rejects unknown names
+func parseMode(name string) (*ModeConf, error) {
+	switch name {
+	case ModeFast, ModeNormal, ModeFast2, ModeFast3:
+		return GetModeConf(name), nil
+	default:
+		return nil, fmt.Errorf("unknown mode %q", name)
+	}
+}
+
+// UnmarshalJSON accepts either a mode preset name such as "fast2" or an object
+func (m *ModeConf) UnmarshalJSON(b []byte) error {
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '"' {
+		var name string
+		if err := json.Unmarshal(b, &name); err != nil {
+			return err
+		}
+
+		preset, err := parseMode(name)
+		if err != nil {
+			return err
+		}
+
+		*m = *preset
+		return nil
+	}
+
+	type plain ModeConf
+	return json.Unmarshal(b, (*plain)(m))
+}
+
+// UnmarshalYAML accepts either a mode preset name such as "fast2" or a mapping
+func (m *ModeConf) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		preset, err := parseMode(value.Value)
+		if err != nil {
+			return err
+		}
+
+		*m = *preset
+		return nil
+	}
+
+	type plain ModeConf
+	return value.Decode((*plain)(m))
+}
+
+// UnmarshalJSON fills the fields missing from b with DefaultMuxConf
+func (c *MuxConf) UnmarshalJSON(b []byte) error {
+	type plain MuxConf
+	if *c == (MuxConf{}) {
+		*c = *DefaultMuxConf()
+	}
+
+	return json.Unmarshal(b, (*plain)(c))
+}
+
+// UnmarshalYAML fills the fields missing from value with DefaultMuxConf
+func (c *MuxConf) UnmarshalYAML(value *yaml.Node) error {
+	type plain MuxConf
+	if *c == (MuxConf{}) {
+		*c = *DefaultMuxConf()
+	}
+
+	return value.Decode((*plain)(c))
+}
@@ -0,0 +1,150 @@
+package xkcp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfig_JSON(t *testing.T) {
+	path := writeTestConfig(t, "kcp.json", `{
+		"seed": "file-seed",
+		"mtu": 1350,
+		"mode": "fast3",
+		"fec": {"datashard": 0, "parityshard": 0}
+	}`)
+
+	conf, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, "file-seed", conf.Seed)
+	require.Equal(t, 1350, conf.MTU)
+	require.Equal(t, GetModeConf(ModeFast3), conf.ModeConf)
+	require.Equal(t, &FECConf{}, conf.FECConf)
+
+	// unset fields come from DefaultConfig
+	def := DefaultConfig()
+	require.Equal(t, def.Crypt, conf.Crypt)
+	require.Equal(t, def.SndWnd, conf.SndWnd)
+	require.Equal(t, def.SockBuf, conf.SockBuf)
+	require.Nil(t, conf.MuxConf)
+}
+
+func TestLoadConfig_YAML(t *testing.T) {
+	path := writeTestConfig(t, "kcp.yaml", `
+seed: yaml-seed
+crypt: aes-128
+handshake: true
+mode:
+  interval: 20
+mux:
+  maxstreambuffer: 65536
+`)
+
+	conf, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, "yaml-seed", conf.Seed)
+	require.Equal(t, "aes-128", conf.Crypt)
+	require.True(t, conf.Handshake)
+
+	// a partial mode object refines the default preset
+	want := GetModeConf(ModeNormal)
+	want.Interval = 20
+	require.Equal(t, want, conf.ModeConf)
+
+	// a partial mux object is completed from DefaultMuxConf
+	wantMux := DefaultMuxConf()
+	wantMux.MaxStreamBuffer = 65536
+	require.Equal(t, wantMux, conf.MuxConf)
+}
+
+func TestLoadConfig_YAMLModeName(t *testing.T) {
+	conf, err := LoadConfigYAML(strings.NewReader("mode: fast2\n"))
+	require.NoError(t, err)
+	require.Equal(t, GetModeConf(ModeFast2), conf.ModeConf)
+}
+
+func TestLoadConfig_Env(t *testing.T) {
+	t.Setenv("XKCP_MTU", "1400")
+	t.Setenv("XKCP_CRYPT", "null")
+	t.Setenv("XKCP_MODE", "fast")
+	t.Setenv("XKCP_RESEND", "0")
+	t.Setenv("XKCP_ACKNODELAY", "true")
+	t.Setenv("XKCP_HANDSHAKE", "true")
+	t.Setenv("XKCP_MUX", "1")
+	t.Setenv("XKCP_KDF", KDFHKDF)
+	t.Setenv("XKCP_KDF_SALT", "deployment-salt")
+	t.Setenv("XKCP_KEEPALIVE", "1000")
+	t.Setenv("XKCP_IDLETIMEOUT", "5000")
+	t.Setenv("XKCP_MAXSESSIONS", "100")
+	t.Setenv("XKCP_REFUSE", "true")
+	t.Setenv("XKCP_COOKIE_THRESHOLD", "200")
+	t.Setenv("XKCP_SENDRATE", "1048576")
+	t.Setenv("XKCP_GLOBAL_RECVRATE", "16777216")
+	t.Setenv("XKCP_POOL_WORKERS", "64")
+	t.Setenv("XKCP_POOL_FULL", PoolFullReject)
+
+	path := writeTestConfig(t, "kcp.json", `{"mtu": 1300, "crypt": "aes"}`)
+
+	conf, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, 1400, conf.MTU)
+	require.Equal(t, "null", conf.Crypt)
+	require.True(t, conf.AckNodelay)
+	require.True(t, conf.Handshake)
+	require.Equal(t, DefaultMuxConf(), conf.MuxConf)
+	require.Equal(t, &KDFConf{Algorithm: KDFHKDF, Salt: "deployment-salt"}, conf.KDFConf)
+	require.Equal(t, 1000, conf.KeepAlive)
+	require.Equal(t, 5000, conf.IdleTimeout)
+	require.Equal(t, &LimitConf{MaxSessions: 100, Refuse: true}, conf.LimitConf)
+	require.Equal(t, &CookieConf{Threshold: 200}, conf.CookieConf)
+	require.Equal(t, &RateConf{SendRate: 1 << 20, GlobalRecvRate: 1 << 24}, conf.RateConf)
+	require.Equal(t, &PoolConf{Workers: 64, Full: PoolFullReject}, conf.PoolConf)
+
+	want := GetModeConf(ModeFast)
+	want.Resend = 0
+	require.Equal(t, want, conf.ModeConf)
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("XKCP_DATASHARD", "0")
+	t.Setenv("XKCP_PARITYSHARD", "0")
+
+	conf, err := LoadConfigEnv()
+	require.NoError(t, err)
+	require.Equal(t, &FECConf{}, conf.FECConf)
+
+	t.Setenv("XKCP_MTU", "large")
+	_, err = LoadConfigEnv()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "XKCP_MTU")
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	_, err := LoadConfig(writeTestConfig(t, "kcp.toml", `mtu = 1200`))
+	require.Error(t, err)
+
+	_, err = LoadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	require.True(t, errors.Is(err, os.ErrNotExist))
+
+	_, err = LoadConfigJSON(strings.NewReader(`{"mode": "warp"}`))
+	require.Error(t, err)
+
+	_, err = LoadConfigJSON(strings.NewReader(`{"mtuu": 1200}`))
+	require.Error(t, err)
+
+	// the loaded config is validated
+	_, err = LoadConfigYAML(strings.NewReader("dscp: 99\n"))
+	var ce *ConfigError
+	require.True(t, errors.As(err, &ce))
+	require.Equal(t, "DSCP", ce.Field)
+}
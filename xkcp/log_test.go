@@ -0,0 +1,168 @@
+package xkcp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testLogHandler records every event at or above its level
+type testLogHandler struct {
+	level slog.Level
+
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *testLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *testLogHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	h.records = append(h.records, r.Clone())
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *testLogHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *testLogHandler) WithGroup(string) slog.Handler      { return h }
+
+// find returns the attributes of the first event logged with msg
+func (h *testLogHandler) find(msg string) (map[string]string, slog.Level, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, r := range h.records {
+		if r.Message != msg {
+			continue
+		}
+
+		attrs := make(map[string]string)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value.String()
+			return true
+		})
+		return attrs, r.Level, true
+	}
+
+	return nil, 0, false
+}
+
+func (h *testLogHandler) eventually(t *testing.T, msg string) map[string]string {
+	var attrs map[string]string
+	require.Eventually(t, func() bool {
+		var ok bool
+		attrs, _, ok = h.find(msg)
+		return ok
+	}, 2*time.Second, 10*time.Millisecond, "no %q event", msg)
+	return attrs
+}
+
+func TestLogger_ServerEvents(t *testing.T) {
+	h := &testLogHandler{level: slog.LevelDebug}
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.AuthConf = &AuthConf{Tokens: map[string]string{"alice": "alice-token"}}
+	conf.Logger = slog.New(h)
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testEchoHandler{})
+	require.NoError(t, err)
+
+	attrs, level, ok := h.find("xkcp: listening")
+	require.True(t, ok)
+	require.Equal(t, slog.LevelInfo, level)
+	require.Equal(t, saddr, attrs["addr"])
+	require.Equal(t, "true", attrs["auth"])
+
+	alice := DefaultConfig()
+	alice.Handshake = true
+	alice.AuthConf = &AuthConf{Token: "alice-token"}
+	_, err = testAuthDial(t, saddr, alice)
+	require.NoError(t, err)
+	require.Equal(t, "token:alice", h.eventually(t, "xkcp: handshake completed")["identity"])
+
+	guess := DefaultConfig()
+	guess.Handshake = true
+	guess.AuthConf = &AuthConf{Token: "guess"}
+	_, err = testAuthDial(t, saddr, guess)
+	require.Error(t, err)
+	require.Contains(t, h.eventually(t, "xkcp: handshake failed")["err"], "unknown credential")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	server.Shutdown(ctx)
+
+	h.eventually(t, "xkcp: shutting down")
+	// the session of alice, and the one of the rejected client when it is
+	// still closing or its retransmissions opened another
+	dropped, err := strconv.Atoi(h.eventually(t, "xkcp: shutdown timed out")["dropped"])
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, dropped, 1)
+	h.eventually(t, "xkcp: server closed")
+	h.eventually(t, "xkcp: session closed")
+}
+
+func TestLogger_Levels(t *testing.T) {
+	h := &testLogHandler{level: slog.LevelInfo}
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.Logger = slog.New(h)
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := DialContext(context.Background(), saddr, conf)
+	require.NoError(t, err)
+	client.Close()
+
+	_, _, ok := h.find("xkcp: listening")
+	require.True(t, ok)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		require.True(t, r.Level >= slog.LevelInfo, "%q logged below the handler level", r.Message)
+	}
+}
+
+// plainPacketConn hides the socket options of the wrapped connection
+type plainPacketConn struct {
+	net.PacketConn
+}
+
+func TestLogger_SocketOptions(t *testing.T) {
+	h := &testLogHandler{level: slog.LevelDebug}
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.DSCP = 46
+	conf.Logger = slog.New(h)
+
+	conn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+
+	server, err := NewServerWithConn(plainPacketConn{conn}, conf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	attrs, level, ok := h.find("xkcp: socket option not applied")
+	require.True(t, ok)
+	require.Equal(t, slog.LevelWarn, level)
+	require.Equal(t, "dscp", attrs["option"])
+
+	client, err := DialContext(context.Background(), conn.LocalAddr().String(), conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	attrs = h.eventually(t, "xkcp: session dialed")
+	require.Equal(t, conn.LocalAddr().String(), attrs["remote"])
+}
@@ -0,0 +1,325 @@
+package xkcp
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// Session roles reported in SessionStats.Role
+const (
+	RoleServer = "server"
+	RoleClient = "client"
+)
+
+// Metrics collects the global kcp-go SNMP counters along with the sessions
+// of every Server and Client. It exports them in the Prometheus text format
+// as an http.Handler and as JSON as an expvar.Var:
+//
+//	http.Handle("/metrics", xkcp.DefaultMetrics)
+//	expvar.Publish("xkcp", xkcp.DefaultMetrics)
+type Metrics struct {
+	mu       sync.Mutex
+	sessions map[*kcp.UDPSession]*sessionEntry
+
+	accepted          atomic.Uint64
+	handshakeFailures atomic.Uint64
+	dialed            atomic.Uint64
+	idleTimeouts      atomic.Uint64
+	handlerPanics     atomic.Uint64
+	cookieChallenges  atomic.Uint64
+	rejected          map[string]uint64 // by reject reason, guarded by mu
+}
+
+// sessionEntry is what Metrics knows about a live session besides kcp-go state
+type sessionEntry struct {
+	role  string
+	id    *Identity
+	since time.Time
+	rates *sessionRates // counts the application bytes
+}
+
+// DefaultMetrics is where Servers and Clients register their sessions unless
+// they were created with WithMetrics
+var DefaultMetrics = NewMetrics()
+
+// NewMetrics returns an empty collector
+func NewMetrics() *Metrics {
+	return &Metrics{
+		sessions: make(map[*kcp.UDPSession]*sessionEntry),
+		rejected: make(map[string]uint64),
+	}
+}
+
+// SessionStats describes a live session. Round trip times are those measured
+// by KCP, with a millisecond resolution. BytesIn and BytesOut count the
+// application data read and written through a Client, the Conn of a
+// ContextHandler, Server.Limited and multiplexed streams, they stay zero for
+// a ServerConnHandler working on the raw session. kcp-go v5 only keeps
+// retransmissions, lost segments, FEC recoveries and the other transport
+// counters globally, see MetricsSnapshot.Snmp.
+type SessionStats struct {
+	Role       string        `json:"role"`
+	Conv       uint32        `json:"conv"`
+	LocalAddr  string        `json:"local_addr"`
+	RemoteAddr string        `json:"remote_addr"`
+	Identity   string        `json:"identity,omitempty"` // see Identity.String, empty when unauthenticated
+	Since      time.Time     `json:"since"`              // end of the session handshake
+	SRTT       time.Duration `json:"srtt"`
+	RTTVar     time.Duration `json:"rttvar"`
+	RTO        time.Duration `json:"rto"`
+	BytesIn    uint64        `json:"bytes_in"`
+	BytesOut   uint64        `json:"bytes_out"`
+}
+
+// MetricsSnapshot is a point in time copy of a Metrics
+type MetricsSnapshot struct {
+	Snmp              kcp.Snmp          `json:"snmp"`
+	Accepted          uint64            `json:"accepted"`           // sessions accepted by servers
+	HandshakeFailures uint64            `json:"handshake_failures"` // sessions servers dropped during the handshake
+	Dialed            uint64            `json:"dialed"`             // sessions opened by clients
+	IdleTimeouts      uint64            `json:"idle_timeouts"`      // sessions closed by IdleTimeout
+	HandlerPanics     uint64            `json:"handler_panics"`     // panics recovered from server handlers
+	Rejected          map[string]uint64 `json:"rejected"`           // sessions servers rejected, by reject reason
+	CookieChallenges  uint64            `json:"cookie_challenges"`  // cookie challenges sent to peers without a session
+	Sessions          []SessionStats    `json:"sessions"`           // sorted by role and conv
+}
+
+// addSession registers a session that completed its handshake, rates are
+// those of its limited conns
+func (m *Metrics) addSession(conn *kcp.UDPSession, role string, id *Identity, rates *sessionRates) {
+	m.mu.Lock()
+	m.sessions[conn] = &sessionEntry{role: role, id: id, since: time.Now(), rates: rates}
+	m.mu.Unlock()
+}
+
+// addRejected counts a session rejected for reason
+func (m *Metrics) addRejected(reason string) {
+	m.mu.Lock()
+	m.rejected[reason]++
+	m.mu.Unlock()
+}
+
+// removeSession forgets a session, it is a no-op for unknown sessions
+func (m *Metrics) removeSession(conn *kcp.UDPSession) {
+	m.mu.Lock()
+	delete(m.sessions, conn)
+	m.mu.Unlock()
+}
+
+// sessionStats returns the stats of a registered session
+func (m *Metrics) sessionStats(conn *kcp.UDPSession) (SessionStats, bool) {
+	m.mu.Lock()
+	e, ok := m.sessions[conn]
+	m.mu.Unlock()
+
+	if !ok {
+		return SessionStats{}, false
+	}
+
+	return newSessionStats(conn, e), true
+}
+
+func newSessionStats(conn *kcp.UDPSession, e *sessionEntry) SessionStats {
+	st := SessionStats{
+		Role:       e.role,
+		Conv:       conn.GetConv(),
+		LocalAddr:  conn.LocalAddr().String(),
+		RemoteAddr: conn.RemoteAddr().String(),
+		Since:      e.since,
+		SRTT:       time.Duration(conn.GetSRTT()) * time.Millisecond,
+		RTTVar:     time.Duration(conn.GetSRTTVar()) * time.Millisecond,
+		RTO:        time.Duration(conn.GetRTO()) * time.Millisecond,
+		BytesIn:    e.rates.read.Load(),
+		BytesOut:   e.rates.written.Load(),
+	}
+
+	if e.id != nil {
+		st.Identity = e.id.String()
+	}
+
+	return st
+}
+
+// Snapshot returns the current counters and the stats of every live session
+func (m *Metrics) Snapshot() *MetricsSnapshot {
+	snap := &MetricsSnapshot{
+		Snmp:              *kcp.DefaultSnmp.Copy(),
+		Accepted:          m.accepted.Load(),
+		HandshakeFailures: m.handshakeFailures.Load(),
+		Dialed:            m.dialed.Load(),
+		IdleTimeouts:      m.idleTimeouts.Load(),
+		HandlerPanics:     m.handlerPanics.Load(),
+		CookieChallenges:  m.cookieChallenges.Load(),
+		Rejected:          make(map[string]uint64),
+		Sessions:          []SessionStats{},
+	}
+
+	m.mu.Lock()
+	for _, reason := range RejectReasons {
+		snap.Rejected[reason] = m.rejected[reason]
+	}
+	for conn, e := range m.sessions {
+		snap.Sessions = append(snap.Sessions, newSessionStats(conn, e))
+	}
+	m.mu.Unlock()
+
+	slices.SortFunc(snap.Sessions, func(a, b SessionStats) int {
+		return cmp.Or(cmp.Compare(a.Role, b.Role), cmp.Compare(a.Conv, b.Conv))
+	})
+
+	return snap
+}
+
+// String returns the snapshot as JSON, it makes Metrics an expvar.Var
+func (m *Metrics) String() string {
+	b, err := json.Marshal(m.Snapshot())
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// ServeHTTP writes the snapshot in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Snapshot().WritePrometheus(w)
+}
+
+// snmpMetrics maps the kcp-go SNMP counters to Prometheus metrics
+var snmpMetrics = []struct {
+	name, typ, help string
+	value           func(*kcp.Snmp) uint64
+}{
+	{"bytes_sent_total", "counter", "Bytes sent from the upper level.", func(s *kcp.Snmp) uint64 { return s.BytesSent }},
+	{"bytes_received_total", "counter", "Bytes received to the upper level.", func(s *kcp.Snmp) uint64 { return s.BytesReceived }},
+	{"max_conn", "gauge", "Maximum number of connections ever reached.", func(s *kcp.Snmp) uint64 { return s.MaxConn }},
+	{"active_opens_total", "counter", "Connections opened actively.", func(s *kcp.Snmp) uint64 { return s.ActiveOpens }},
+	{"passive_opens_total", "counter", "Connections opened passively.", func(s *kcp.Snmp) uint64 { return s.PassiveOpens }},
+	{"curr_estab", "gauge", "Currently established connections.", func(s *kcp.Snmp) uint64 { return s.CurrEstab }},
+	{"in_errors_total", "counter", "UDP read errors.", func(s *kcp.Snmp) uint64 { return s.InErrs }},
+	{"in_csum_errors_total", "counter", "Packets failing the CRC32 check.", func(s *kcp.Snmp) uint64 { return s.InCsumErrors }},
+	{"kcp_in_errors_total", "counter", "Packets rejected by KCP.", func(s *kcp.Snmp) uint64 { return s.KCPInErrors }},
+	{"in_packets_total", "counter", "Incoming packets.", func(s *kcp.Snmp) uint64 { return s.InPkts }},
+	{"out_packets_total", "counter", "Outgoing packets.", func(s *kcp.Snmp) uint64 { return s.OutPkts }},
+	{"in_segments_total", "counter", "Incoming KCP segments.", func(s *kcp.Snmp) uint64 { return s.InSegs }},
+	{"out_segments_total", "counter", "Outgoing KCP segments.", func(s *kcp.Snmp) uint64 { return s.OutSegs }},
+	{"in_bytes_total", "counter", "UDP bytes received.", func(s *kcp.Snmp) uint64 { return s.InBytes }},
+	{"out_bytes_total", "counter", "UDP bytes sent.", func(s *kcp.Snmp) uint64 { return s.OutBytes }},
+	{"retrans_segments_total", "counter", "Retransmitted segments.", func(s *kcp.Snmp) uint64 { return s.RetransSegs }},
+	{"fast_retrans_segments_total", "counter", "Fast retransmitted segments.", func(s *kcp.Snmp) uint64 { return s.FastRetransSegs }},
+	{"early_retrans_segments_total", "counter", "Early retransmitted segments.", func(s *kcp.Snmp) uint64 { return s.EarlyRetransSegs }},
+	{"lost_segments_total", "counter", "Segments inferred as lost.", func(s *kcp.Snmp) uint64 { return s.LostSegs }},
+	{"repeat_segments_total", "counter", "Duplicated segments received.", func(s *kcp.Snmp) uint64 { return s.RepeatSegs }},
+	{"fec_parity_shards_total", "counter", "FEC parity shards received.", func(s *kcp.Snmp) uint64 { return s.FECParityShards }},
+	{"fec_errors_total", "counter", "Incorrect packets recovered from FEC.", func(s *kcp.Snmp) uint64 { return s.FECErrs }},
+	{"fec_recovered_total", "counter", "Packets recovered from FEC.", func(s *kcp.Snmp) uint64 { return s.FECRecovered }},
+	{"fec_short_shards_total", "counter", "FEC groups with too few shards to recover.", func(s *kcp.Snmp) uint64 { return s.FECShortShards }},
+}
+
+// WritePrometheus writes the snapshot in the Prometheus text exposition format
+func (snap *MetricsSnapshot) WritePrometheus(w io.Writer) error {
+	pw := &promWriter{w: w}
+
+	for _, m := range snmpMetrics {
+		pw.header("xkcp_snmp_"+m.name, m.typ, m.help)
+		pw.sample("xkcp_snmp_"+m.name, nil, float64(m.value(&snap.Snmp)))
+	}
+
+	pw.header("xkcp_sessions_accepted_total", "counter", "Sessions accepted by servers.")
+	pw.sample("xkcp_sessions_accepted_total", nil, float64(snap.Accepted))
+	pw.header("xkcp_handshake_failures_total", "counter", "Sessions servers dropped during the handshake.")
+	pw.sample("xkcp_handshake_failures_total", nil, float64(snap.HandshakeFailures))
+	pw.header("xkcp_sessions_dialed_total", "counter", "Sessions opened by clients.")
+	pw.sample("xkcp_sessions_dialed_total", nil, float64(snap.Dialed))
+	pw.header("xkcp_idle_timeouts_total", "counter", "Sessions closed for being idle.")
+	pw.sample("xkcp_idle_timeouts_total", nil, float64(snap.IdleTimeouts))
+	pw.header("xkcp_handler_panics_total", "counter", "Panics recovered from server handlers.")
+	pw.sample("xkcp_handler_panics_total", nil, float64(snap.HandlerPanics))
+
+	pw.header("xkcp_sessions_rejected_total", "counter", "Sessions servers rejected for being over a limit.")
+	for _, reason := range RejectReasons {
+		pw.sample("xkcp_sessions_rejected_total", []string{"reason", reason}, float64(snap.Rejected[reason]))
+	}
+
+	pw.header("xkcp_cookie_challenges_total", "counter", "Cookie challenges sent to peers without a session.")
+	pw.sample("xkcp_cookie_challenges_total", nil, float64(snap.CookieChallenges))
+
+	active := map[string]int{RoleServer: 0, RoleClient: 0}
+	for _, st := range snap.Sessions {
+		active[st.Role]++
+	}
+	pw.header("xkcp_sessions", "gauge", "Live sessions.")
+	for _, role := range []string{RoleClient, RoleServer} {
+		pw.sample("xkcp_sessions", []string{"role", role}, float64(active[role]))
+	}
+
+	perSession := []struct {
+		name, typ, help string
+		value           func(SessionStats) float64
+	}{
+		{"xkcp_session_srtt_seconds", "gauge", "Smoothed round trip time of the session.", func(st SessionStats) float64 { return st.SRTT.Seconds() }},
+		{"xkcp_session_rttvar_seconds", "gauge", "Round trip time variance of the session.", func(st SessionStats) float64 { return st.RTTVar.Seconds() }},
+		{"xkcp_session_rto_seconds", "gauge", "Retransmission timeout of the session.", func(st SessionStats) float64 { return st.RTO.Seconds() }},
+		{"xkcp_session_start_time_seconds", "gauge", "Unix time the session completed its handshake.", func(st SessionStats) float64 {
+			return float64(st.Since.UnixNano()) / 1e9
+		}},
+		{"xkcp_session_in_bytes_total", "counter", "Application bytes read from the session.", func(st SessionStats) float64 { return float64(st.BytesIn) }},
+		{"xkcp_session_out_bytes_total", "counter", "Application bytes written to the session.", func(st SessionStats) float64 { return float64(st.BytesOut) }},
+	}
+
+	for _, m := range perSession {
+		pw.header(m.name, m.typ, m.help)
+		for _, st := range snap.Sessions {
+			labels := []string{"role", st.Role, "conv", fmt.Sprint(st.Conv), "remote", st.RemoteAddr, "identity", st.Identity}
+			pw.sample(m.name, labels, m.value(st))
+		}
+	}
+
+	return pw.err
+}
+
+// promWriter writes Prometheus text samples, keeping the first write error
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (pw *promWriter) header(name, typ, help string) {
+	pw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample, labels alternate names and values
+func (pw *promWriter) sample(name string, labels []string, value float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], promLabelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+
+	pw.printf("%s %v\n", b.String(), value)
+}
+
+func (pw *promWriter) printf(format string, args ...any) {
+	if pw.err == nil {
+		_, pw.err = fmt.Fprintf(pw.w, format, args...)
+	}
+}
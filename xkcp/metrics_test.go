@@ -0,0 +1,181 @@
+package xkcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// findSession returns the stats of the session with conv and role in snap
+func findSession(snap *MetricsSnapshot, role string, conv uint32) (SessionStats, bool) {
+	for _, st := range snap.Sessions {
+		if st.Role == role && st.Conv == conv {
+			return st, true
+		}
+	}
+	return SessionStats{}, false
+}
+
+func TestMetrics_Sessions(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	before := DefaultMetrics.Snapshot()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialContext(ctx, saddr, conf)
+	require.NoError(t, err)
+
+	testEcho(t, client)
+
+	conv := client.GetConv()
+	st := client.Stats()
+	require.Equal(t, RoleClient, st.Role)
+	require.Equal(t, conv, st.Conv)
+	require.Equal(t, saddr, st.RemoteAddr)
+	require.NotZero(t, st.RTO)
+
+	require.Eventually(t, func() bool { return len(server.Stats()) == 1 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, conv, server.Stats()[0].Conv)
+	require.Equal(t, RoleServer, server.Stats()[0].Role)
+
+	snap := DefaultMetrics.Snapshot()
+	require.Equal(t, before.Accepted+1, snap.Accepted)
+	require.Equal(t, before.Dialed+1, snap.Dialed)
+	require.Greater(t, snap.Snmp.BytesSent, before.Snmp.BytesSent)
+
+	_, ok := findSession(snap, RoleClient, conv)
+	require.True(t, ok)
+	_, ok = findSession(snap, RoleServer, conv)
+	require.True(t, ok)
+
+	client.Close()
+	_, ok = findSession(DefaultMetrics.Snapshot(), RoleClient, conv)
+	require.False(t, ok, "closed client still registered")
+	require.Zero(t, client.Stats())
+
+	// KCP has no close notification, the server session lives until its handler returns
+	server.Close()
+	require.Eventually(t, func() bool {
+		_, ok := findSession(DefaultMetrics.Snapshot(), RoleServer, conv)
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond, "server session still registered")
+}
+
+func TestMetrics_SessionBytes(t *testing.T) {
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithContextHandler(HandlerFunc(testContextEchoLoop)))
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, saddr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+	testEcho(t, client)
+
+	st := client.Stats()
+	require.EqualValues(t, 10, st.BytesIn)
+	require.EqualValues(t, 10, st.BytesOut)
+
+	require.Eventually(t, func() bool {
+		stats := server.Stats()
+		return len(stats) == 1 && stats[0].BytesIn == 10 && stats[0].BytesOut == 10
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMetrics_HandshakeFailures(t *testing.T) {
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.AuthConf = &AuthConf{Tokens: map[string]string{"alice": "alice-token"}}
+	server, err := NewServer(saddr, conf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	before := DefaultMetrics.Snapshot().HandshakeFailures
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	guess := DefaultConfig()
+	guess.Handshake = true
+	guess.AuthConf = &AuthConf{Token: "guess"}
+	_, err = DialContext(ctx, saddr, guess)
+	require.Error(t, err)
+
+	require.Eventually(t, func() bool {
+		return DefaultMetrics.Snapshot().HandshakeFailures == before+1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMetrics_Prometheus(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := DialContext(context.Background(), saddr, conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	rec := httptest.NewRecorder()
+	DefaultMetrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+
+	body := rec.Body.String()
+	require.Contains(t, body, "# TYPE xkcp_snmp_bytes_sent_total counter\n")
+	require.Contains(t, body, "# TYPE xkcp_snmp_curr_estab gauge\n")
+	require.Contains(t, body, "xkcp_sessions_dialed_total ")
+	require.Contains(t, body, `xkcp_sessions_rejected_total{reason="rate"} `)
+	require.Contains(t, body, "xkcp_handler_panics_total ")
+	require.Contains(t, body, fmt.Sprintf(`xkcp_session_rto_seconds{role="client",conv="%d",remote="%s",identity=""} `, client.GetConv(), saddr))
+	require.Contains(t, body, "# TYPE xkcp_session_in_bytes_total counter\n")
+
+	// every line is a comment or a sample
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		_, err := strconv.ParseFloat(line[strings.LastIndexByte(line, ' ')+1:], 64)
+		require.NoError(t, err, "malformed sample %q", line)
+	}
+}
+
+func TestMetrics_Expvar(t *testing.T) {
+	var snap MetricsSnapshot
+	require.NoError(t, json.Unmarshal([]byte(DefaultMetrics.String()), &snap))
+	require.NotNil(t, snap.Sessions)
+}
+
+func TestPromWriter_EscapesLabels(t *testing.T) {
+	var buf bytes.Buffer
+	pw := &promWriter{w: &buf}
+	pw.sample("xkcp_test", []string{"identity", "token:a\"b\\c\nd"}, 1.5)
+	require.NoError(t, pw.err)
+	require.Equal(t, `xkcp_test{identity="token:a\"b\\c\nd"} 1.5`+"\n", buf.String())
+}
@@ -0,0 +1,148 @@
+package xkcp
+
+import (
+	"log/slog"
+	"net"
+)
+
+// Option configures a Server created by StartServer or Listen, or a Client
+// created by Dial. Options that only make sense on one side are ignored by the
+// other.
+type Option func(*options)
+
+type options struct {
+	conf       *KcpConfig
+	localAddr  string
+	conn       net.PacketConn
+	ownConn    bool
+	logger     *slog.Logger
+	handler    ContextHandler
+	metrics    *Metrics
+	hooks      Hooks
+	onShutdown []func()
+	bestEffort bool
+	repanic    bool
+}
+
+// newOptions applies opts over the defaults: DefaultConfig with Handshake,
+// which Dial needs, DefaultMetrics and the logger of the config
+func newOptions(opts []Option) *options {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	o := &options{
+		conf:    conf,
+		metrics: DefaultMetrics,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// getLogger returns the logger set by WithLogger, or the one of the config
+func (o *options) getLogger() *slog.Logger {
+	if o.logger != nil {
+		return o.logger
+	}
+	return o.conf.logger()
+}
+
+// WithConfig sets the config, DefaultConfig() with Handshake set is used
+// otherwise. conf must not be modified afterwards.
+func WithConfig(conf *KcpConfig) Option {
+	return func(o *options) {
+		o.conf = conf
+	}
+}
+
+// getHooks returns the hooks set by WithHooks, or NopHooks
+func (o *options) getHooks() Hooks {
+	if o.hooks != nil {
+		return o.hooks
+	}
+	return NopHooks{}
+}
+
+// WithLocalAddr binds the socket of a Client to addr. It is ignored together
+// with WithPacketConn.
+func WithLocalAddr(addr string) Option {
+	return func(o *options) {
+		o.localAddr = addr
+	}
+}
+
+// WithPacketConn runs a Server or Client over an existing packet connection
+// instead of a new UDP socket. A Server closes conn when it is closed, a
+// Client leaves it open and stops reading it, see DialContextWithConn.
+func WithPacketConn(conn net.PacketConn) Option {
+	return func(o *options) {
+		o.conn = conn
+	}
+}
+
+// WithLogger sets the logger, it takes precedence over KcpConfig.Logger
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithHandler sets the handler of a Server
+func WithHandler(handler ServerConnHandler) Option {
+	return func(o *options) {
+		o.handler = nil
+		if handler != nil {
+			o.handler = connHandler{handler}
+		}
+	}
+}
+
+// WithContextHandler sets the handler of a Server, in place of WithHandler
+func WithContextHandler(handler ContextHandler) Option {
+	return func(o *options) {
+		o.handler = handler
+	}
+}
+
+// WithMetrics registers sessions with m instead of DefaultMetrics, m must not be nil
+func WithMetrics(m *Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// WithHooks makes a Server report the events of its sessions to h
+func WithHooks(h Hooks) Option {
+	return func(o *options) {
+		o.hooks = h
+	}
+}
+
+// WithOnShutdown registers f with Server.RegisterOnShutdown before the server
+// starts accepting sessions
+func WithOnShutdown(f func()) Option {
+	return func(o *options) {
+		o.onShutdown = append(o.onShutdown, f)
+	}
+}
+
+// WithRepanic makes a Server panic again once it recovered a panic of a
+// handler and closed its session, for debugging. Otherwise the process keeps
+// running.
+func WithRepanic() Option {
+	return func(o *options) {
+		o.repanic = true
+	}
+}
+
+// WithBestEffortSocketOptions makes a Server log the socket options of the
+// config (DSCP, SockBuf) that cannot be applied instead of failing. It is
+// how NewServerWithConn treats connections that may not support them.
+func WithBestEffortSocketOptions() Option {
+	return func(o *options) {
+		o.bestEffort = true
+	}
+}
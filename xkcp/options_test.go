@@ -0,0 +1,133 @@
+package xkcp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartServer_Defaults(t *testing.T) {
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithHandler(&testEchoHandler{}))
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, saddr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+}
+
+func TestStartServer_Options(t *testing.T) {
+	h := &testLogHandler{level: slog.LevelDebug}
+	metrics := NewMetrics()
+	shutdown := make(chan struct{})
+
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.Seed = "options-seed"
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr,
+		WithConfig(conf),
+		WithHandler(&testEchoHandler{}),
+		WithLogger(slog.New(h)),
+		WithMetrics(metrics),
+		WithOnShutdown(func() { close(shutdown) }),
+	)
+	require.NoError(t, err)
+
+	_, _, ok := h.find("xkcp: listening")
+	require.True(t, ok)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, saddr, WithConfig(conf), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+
+	snap := metrics.Snapshot()
+	require.EqualValues(t, 1, snap.Accepted)
+	require.EqualValues(t, 1, snap.Dialed)
+	_, ok = findSession(DefaultMetrics.Snapshot(), RoleClient, client.GetConv())
+	require.False(t, ok, "session registered with DefaultMetrics")
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shutdownCancel()
+	server.Shutdown(shutdownCtx)
+
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second):
+		t.Fatal("WithOnShutdown function not called")
+	}
+}
+
+func TestStartServer_PacketConn(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.DSCP = 46
+
+	conn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// socket options are required unless asked otherwise
+	_, err = StartServer("", WithPacketConn(plainPacketConn{conn}), WithConfig(conf))
+	require.Error(t, err)
+
+	server, err := StartServer("", WithPacketConn(plainPacketConn{conn}), WithConfig(conf),
+		WithHandler(&testEchoHandler{}), WithBestEffortSocketOptions())
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, conn.LocalAddr().String(), WithConfig(conf))
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+}
+
+func TestDial_Options(t *testing.T) {
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithHandler(&testEchoHandler{}))
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	local := getTestAddr()
+	client, err := Dial(ctx, saddr, WithLocalAddr(local))
+	require.NoError(t, err)
+	require.Equal(t, local, client.LocalAddr().String())
+	testEcho(t, client)
+	client.Close()
+
+	conn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client, err = Dial(ctx, saddr, WithPacketConn(conn))
+	require.NoError(t, err)
+	testEcho(t, client)
+	client.Close()
+
+	// the client leaves the connection open
+	_, err = conn.WriteTo([]byte("ping"), conn.LocalAddr())
+	require.NoError(t, err)
+}
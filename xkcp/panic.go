@@ -0,0 +1,47 @@
+package xkcp
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// PanicError is the error of a session whose handler panicked, as passed to
+// Hooks.OnClose
+type PanicError struct {
+	Value any    // as passed to panic
+	Stack []byte // of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("xkcp: handler panicked: %v", e.Value)
+}
+
+// recoverHandler must be deferred by the goroutines running handler code for
+// conn. A panic is logged with its stack, counted and closes the session, it
+// goes on once done with WithRepanic.
+func (s *Server) recoverHandler(conn *kcp.UDPSession) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	perr := &PanicError{Value: v, Stack: debug.Stack()}
+	s.logger.Error("xkcp: handler panicked", "remote", conn.RemoteAddr(), "conv", conn.GetConv(),
+		"panic", fmt.Sprint(v), "stack", string(perr.Stack))
+	s.metrics.handlerPanics.Add(1)
+
+	s.mu.Lock()
+	if sess, ok := s.sessions[conn]; ok {
+		sess.err = perr
+		sess.close(conn, ClosedPanic)
+	} else {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	if s.repanic {
+		panic(v)
+	}
+}
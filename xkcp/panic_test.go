@@ -0,0 +1,145 @@
+package xkcp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// testPanicHandler panics on the sessions and streams that send "panic" and
+// echoes the others
+type testPanicHandler struct{}
+
+func (h *testPanicHandler) ServeConn(ctx context.Context, conn *Conn) error {
+	buf := make([]byte, 64)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if string(buf[:n]) == "panic" {
+			panic("boom")
+		}
+		conn.Write(buf[:n])
+	}
+}
+
+func (h *testPanicHandler) HandleStream(stream net.Conn) {
+	defer stream.Close()
+
+	buf := make([]byte, 64)
+	for {
+		n, err := stream.Read(buf)
+		if err != nil {
+			return
+		}
+		if string(buf[:n]) == "panic" {
+			panic("boom")
+		}
+		stream.Write(buf[:n])
+	}
+}
+
+func TestServer_HandlerPanic(t *testing.T) {
+	hooks := newTestHooks()
+	logs := &testLogHandler{level: slog.LevelError}
+	metrics := NewMetrics()
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithContextHandler(&testPanicHandler{}), WithHooks(hooks),
+		WithLogger(slog.New(logs)), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer server.Close()
+
+	bystander, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	hooks.next(t, "accept")
+
+	client, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	hooks.next(t, "accept")
+
+	_, err = client.Write([]byte("panic"))
+	require.NoError(t, err)
+
+	e := hooks.next(t, "close")
+	require.Equal(t, client.GetConv(), e.conv)
+	require.Equal(t, ClosedPanic, e.reason)
+
+	var perr *PanicError
+	require.True(t, errors.As(e.err, &perr), "unexpected error: %v", e.err)
+	require.Equal(t, "boom", perr.Value)
+	require.Contains(t, string(perr.Stack), "testPanicHandler")
+
+	attrs := logs.eventually(t, "xkcp: handler panicked")
+	require.Equal(t, "boom", attrs["panic"])
+	require.Contains(t, attrs["stack"], "testPanicHandler")
+	require.EqualValues(t, 1, metrics.Snapshot().HandlerPanics)
+
+	// the other sessions go on
+	testEcho(t, bystander)
+	_, ok := server.Get(client.GetConv())
+	require.False(t, ok)
+}
+
+func TestServer_StreamHandlerPanic(t *testing.T) {
+	hooks := newTestHooks()
+	metrics := NewMetrics()
+
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.MuxConf = DefaultMuxConf()
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithConfig(conf), WithContextHandler(&testPanicHandler{}),
+		WithHooks(hooks), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := DialContext(context.Background(), saddr, conf)
+	require.NoError(t, err)
+	defer client.Close()
+	hooks.next(t, "accept")
+
+	stream, err := client.OpenStream()
+	require.NoError(t, err)
+	defer stream.Close()
+
+	_, err = stream.Write([]byte("panic"))
+	require.NoError(t, err)
+
+	e := hooks.next(t, "close")
+	require.Equal(t, ClosedPanic, e.reason)
+
+	var perr *PanicError
+	require.True(t, errors.As(e.err, &perr), "unexpected error: %v", e.err)
+	require.EqualValues(t, 1, metrics.Snapshot().HandlerPanics)
+}
+
+func TestServer_Repanic(t *testing.T) {
+	conn, err := kcp.DialWithOptions(getTestAddr(), nil, 0, 0)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	s := &Server{
+		repanic:  true,
+		logger:   slog.New(&testLogHandler{level: slog.LevelError}),
+		metrics:  NewMetrics(),
+		sessions: make(map[*kcp.UDPSession]*serverSession),
+	}
+
+	v := func() (v any) {
+		defer func() { v = recover() }()
+		defer s.recoverHandler(conn)
+		panic("boom")
+	}()
+
+	require.Equal(t, "boom", v)
+	require.EqualValues(t, 1, s.metrics.Snapshot().HandlerPanics)
+}
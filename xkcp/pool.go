@@ -0,0 +1,115 @@
+package xkcp
+
+import "github.com/xtaci/kcp-go/v5"
+
+// workerPool runs the sessions of a Server on PoolConf.Workers goroutines
+type workerPool struct {
+	full  string
+	slots chan struct{}        // one per session in a worker or in the queue
+	queue chan *kcp.UDPSession // sessions waiting for a worker, never full
+}
+
+func newWorkerPool(conf *PoolConf) *workerPool {
+	size := conf.Workers + conf.Queue
+	return &workerPool{
+		full:  conf.Full,
+		slots: make(chan struct{}, size),
+		queue: make(chan *kcp.UDPSession, size),
+	}
+}
+
+// worker handles the sessions of the queue until the server is closed
+func (s *Server) worker() {
+	for {
+		select {
+		case conn := <-s.pool.queue:
+			s.handleConn(conn)
+			<-s.pool.slots
+		case <-s.done:
+			// the sessions still queued were closed along with the server
+			for {
+				select {
+				case conn := <-s.pool.queue:
+					s.releaseSession(conn)
+					s.untrackSession(conn)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// acquireWorker takes a place in the pool for a session just accepted by
+// loop, applying PoolConf.Full when there is none. It reports false when the
+// session was rejected, or closed along with the server.
+func (s *Server) acquireWorker(conn *kcp.UDPSession, conf *KcpConfig) bool {
+	select {
+	case s.pool.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	switch s.pool.full {
+	case PoolFullReject:
+		s.reject(conn, RejectPoolFull, conf)
+		return false
+	case PoolFullCloseIdle:
+		s.closeIdlest()
+	}
+
+	select {
+	case s.pool.slots <- struct{}{}:
+		return true
+	case <-s.done:
+		conn.Close()
+		return false
+	}
+}
+
+// releaseWorker gives back the place of a session that will not be queued
+func (s *Server) releaseWorker() {
+	<-s.pool.slots
+}
+
+// dispatch hands a tracked session to the pool, or to a goroutine of its own
+// without PoolConf
+func (s *Server) dispatch(conn *kcp.UDPSession) {
+	if s.pool == nil {
+		go s.handleConn(conn)
+		return
+	}
+
+	s.pool.queue <- conn
+}
+
+// closeIdlest closes the session the server has not heard from for the
+// longest, among those that completed their handshake, so that its worker
+// becomes free once the handler returns
+func (s *Server) closeIdlest() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var idlest *kcp.UDPSession
+	var lastRecv int64
+	for conn, sess := range s.sessions {
+		if !sess.accepted || sess.closeReason != "" {
+			continue
+		}
+
+		if sess.peer == nil {
+			continue
+		}
+
+		if last := sess.peer.lastRecv.Load(); idlest == nil || last < lastRecv {
+			idlest, lastRecv = conn, last
+		}
+	}
+
+	if idlest == nil {
+		return
+	}
+
+	s.logger.Info("xkcp: pool full, closing idle session", "remote", idlest.RemoteAddr(), "conv", idlest.GetConv())
+	s.sessions[idlest].close(idlest, ClosedEvicted)
+}
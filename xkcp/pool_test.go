@@ -0,0 +1,117 @@
+package xkcp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testPoolDial dials saddr in the background
+func testPoolDial(t *testing.T, saddr string) <-chan error {
+	dialed := make(chan error, 1)
+	go func() {
+		client, err := testLimitsDial(t, saddr, 5*time.Second)
+		if err == nil {
+			_, err = client.Write([]byte("hello"))
+		}
+		dialed <- err
+	}()
+	return dialed
+}
+
+func TestServer_PoolBlock(t *testing.T) {
+	hooks := newTestHooks()
+
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.PoolConf = &PoolConf{Workers: 1, Queue: 1}
+	conf.LimitConf = &LimitConf{Refuse: true}
+	server, err := StartServer(saddr, WithConfig(conf),
+		WithHandler(&testEchoHandler{}), WithHooks(hooks))
+	require.NoError(t, err)
+	defer server.Close()
+
+	first, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, first)
+	hooks.next(t, "accept")
+
+	// queued until the worker is free
+	dialed := testPoolDial(t, saddr)
+	select {
+	case err := <-dialed:
+		t.Fatalf("session handled by a busy pool: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	require.Equal(t, 1, server.CloseSession(first.GetConv()))
+	require.NoError(t, <-dialed)
+	hooks.next(t, "close")
+	hooks.next(t, "accept")
+}
+
+func TestServer_PoolReject(t *testing.T) {
+	metrics := NewMetrics()
+
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.PoolConf = &PoolConf{Workers: 1, Full: PoolFullReject}
+	conf.LimitConf = &LimitConf{Refuse: true}
+	server, err := StartServer(saddr, WithConfig(conf),
+		WithHandler(&testEchoHandler{}), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, client)
+
+	_, err = testLimitsDial(t, saddr, 5*time.Second)
+	require.True(t, errors.Is(err, ErrRefused), "unexpected error: %v", err)
+	require.Contains(t, err.Error(), RejectPoolFull)
+	require.EqualValues(t, 1, metrics.Snapshot().Rejected[RejectPoolFull])
+
+	// the session in the pool goes on
+	testEcho(t, client)
+}
+
+func TestServer_PoolCloseIdle(t *testing.T) {
+	hooks := newTestHooks()
+
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.PoolConf = &PoolConf{Workers: 2, Full: PoolFullCloseIdle}
+	conf.LimitConf = &LimitConf{Refuse: true}
+	server, err := StartServer(saddr, WithConfig(conf),
+		WithHandler(&testEchoHandler{}), WithHooks(hooks))
+	require.NoError(t, err)
+	defer server.Close()
+
+	quiet, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, quiet)
+	hooks.next(t, "accept")
+
+	busy, err := testLimitsDial(t, saddr, 5*time.Second)
+	require.NoError(t, err)
+	testEcho(t, busy)
+	hooks.next(t, "accept")
+
+	time.Sleep(100 * time.Millisecond)
+	testEcho(t, busy)
+
+	// the quiet session makes room for the new one
+	require.NoError(t, <-testPoolDial(t, saddr))
+
+	e := hooks.next(t, "close")
+	require.Equal(t, quiet.GetConv(), e.conv)
+	require.Equal(t, ClosedEvicted, e.reason)
+	hooks.next(t, "accept")
+
+	testEcho(t, busy)
+}
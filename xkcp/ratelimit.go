@@ -0,0 +1,276 @@
+package xkcp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// minRateBurst is the smallest burst of a limiter, about three KCP segments
+const minRateBurst = 4096
+
+// rateLimiter is a token bucket of bytes whose rate can change at any time.
+// Reservations may overdraw it, the caller then waits for the debt to be
+// paid back, so that reads and writes larger than the burst still work.
+type rateLimiter struct {
+	rate atomic.Int64 // bytes per second, zero is unlimited
+
+	mu     sync.Mutex
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst int) *rateLimiter {
+	l := &rateLimiter{}
+	l.set(rate, burst)
+	return l
+}
+
+// set changes the rate, a zero burst defaults to a tenth of the rate
+func (l *rateLimiter) set(rate, burst int) {
+	if burst <= 0 {
+		burst = rate / 10
+	}
+
+	l.mu.Lock()
+	l.burst = float64(max(burst, minRateBurst))
+	l.tokens = min(l.tokens, l.burst)
+	l.mu.Unlock()
+
+	l.rate.Store(int64(rate))
+}
+
+// chunk returns how many bytes may go through at once, zero when unlimited
+func (l *rateLimiter) chunk() int {
+	if l.rate.Load() == 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.burst)
+}
+
+// reserve takes n bytes and returns how long to wait before using them
+func (l *rateLimiter) reserve(n int) time.Duration {
+	rate := float64(l.rate.Load())
+	if rate == 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = l.burst
+	} else {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*rate)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// rateConn applies the send and receive limiters of a session to its reads
+// and writes, and counts them in the session rates. Reads and writes are
+// split into bursts so that no limiter lets more than its burst through at
+// once. Waiting ends early with io.ErrClosedPipe once done is closed.
+type rateConn struct {
+	net.Conn
+
+	session    *sessionRates
+	send, recv []*rateLimiter // the limiters of the session first, then the shared ones
+	done       <-chan struct{}
+}
+
+// newRateConn limits conn with the rates of its session and, if not nil,
+// the rates shared with other sessions
+func newRateConn(conn net.Conn, session, shared *sessionRates, done <-chan struct{}) *rateConn {
+	c := &rateConn{
+		Conn:    conn,
+		session: session,
+		send:    []*rateLimiter{session.send},
+		recv:    []*rateLimiter{session.recv},
+		done:    done,
+	}
+
+	if shared != nil {
+		c.send = append(c.send, shared.send)
+		c.recv = append(c.recv, shared.recv)
+	}
+
+	return c
+}
+
+// Read reads at most one burst and waits until the receive limiters allow it
+func (c *rateConn) Read(b []byte) (int, error) {
+	if chunk := rateChunk(c.recv); chunk > 0 && len(b) > chunk {
+		b = b[:chunk]
+	}
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.session.read.Add(uint64(n))
+
+		// the peer stays blocked by the receive window meanwhile
+		if werr := c.wait(c.recv, n); err == nil {
+			err = werr
+		}
+	}
+
+	return n, err
+}
+
+// Write writes b burst by burst, as fast as the send limiters allow
+func (c *rateConn) Write(b []byte) (int, error) {
+	chunk := rateChunk(c.send)
+	if chunk == 0 {
+		n, err := c.Conn.Write(b)
+		c.session.written.Add(uint64(n))
+		return n, err
+	}
+
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), chunk)
+		if err := c.wait(c.send, n); err != nil {
+			return written, err
+		}
+
+		n, err := c.Conn.Write(b[:n])
+		c.session.written.Add(uint64(n))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// wait reserves n bytes from every limiter and waits for the slowest
+func (c *rateConn) wait(limiters []*rateLimiter, n int) error {
+	var d time.Duration
+	for _, l := range limiters {
+		d = max(d, l.reserve(n))
+	}
+
+	if d == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-c.done:
+		return io.ErrClosedPipe
+	}
+}
+
+// rateChunk returns the smallest burst of limiters, zero when all are unlimited
+func rateChunk(limiters []*rateLimiter) int {
+	chunk := 0
+	for _, l := range limiters {
+		if c := l.chunk(); c > 0 && (chunk == 0 || c < chunk) {
+			chunk = c
+		}
+	}
+	return chunk
+}
+
+// sessionRates are the limiters of one session, along with the application
+// bytes read and written through them
+type sessionRates struct {
+	send, recv    *rateLimiter
+	read, written atomic.Uint64
+}
+
+func newSessionRates(rc *RateConf) *sessionRates {
+	r := &sessionRates{send: newRateLimiter(0, 0), recv: newRateLimiter(0, 0)}
+	r.set(rc)
+	return r
+}
+
+// set applies the per session rates of rc, nil lifts them
+func (r *sessionRates) set(rc *RateConf) {
+	if rc == nil {
+		rc = &RateConf{}
+	}
+
+	r.send.set(rc.SendRate, rc.Burst)
+	r.recv.set(rc.RecvRate, rc.Burst)
+}
+
+// newGlobalRates returns the limiters shared by the sessions of a server
+func newGlobalRates(rc *RateConf) *sessionRates {
+	r := &sessionRates{send: newRateLimiter(0, 0), recv: newRateLimiter(0, 0)}
+	r.setGlobal(rc)
+	return r
+}
+
+// setGlobal applies the global rates of rc, nil lifts them
+func (r *sessionRates) setGlobal(rc *RateConf) {
+	if rc == nil {
+		rc = &RateConf{}
+	}
+
+	r.send.set(rc.GlobalSendRate, rc.Burst)
+	r.recv.set(rc.GlobalRecvRate, rc.Burst)
+}
+
+// Limited returns conn with the rate limits of the server applied, see
+// RateConf. Multiplexed sessions and the Conn of a ContextHandler are limited
+// already, a ServerConnHandler works on the raw session and must use Limited
+// for its traffic to count.
+// Every call for the same session shares its limiters.
+func (s *Server) Limited(conn *kcp.UDPSession) net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return newRateConn(conn, s.sessionRates(conn), s.globalRates, s.done)
+}
+
+// sessionRates returns the limiters of conn, s.mu must be held
+func (s *Server) sessionRates(conn *kcp.UDPSession) *sessionRates {
+	sess, live := s.sessions[conn]
+	if !live {
+		return newSessionRates(s.conf.Load().RateConf)
+	}
+
+	if sess.rates == nil {
+		// forgotten along with the session
+		sess.rates = newSessionRates(s.conf.Load().RateConf)
+	}
+	return sess.rates
+}
+
+// setRates applies the rates of rc to the server and its sessions, s.mu must be held
+func (s *Server) setRates(rc *RateConf) {
+	s.globalRates.setGlobal(rc)
+	for _, sess := range s.sessions {
+		if sess.rates != nil {
+			sess.rates.set(rc)
+		}
+	}
+}
+
+// SetRateConf changes the rate limits of the client, nil lifts them. The
+// global rates of rc do not apply to a client.
+func (c *Client) SetRateConf(rc *RateConf) {
+	c.rates.set(rc)
+}
@@ -0,0 +1,165 @@
+package xkcp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100000, 10000)
+	require.Equal(t, 10000, l.chunk())
+
+	// the burst goes through, the rest waits for its share of the rate
+	require.Zero(t, l.reserve(10000))
+	d := l.reserve(10000)
+	require.InDelta(t, 100*time.Millisecond, d, float64(10*time.Millisecond))
+
+	l.set(0, 0)
+	require.Zero(t, l.chunk())
+	require.Zero(t, l.reserve(1<<20))
+
+	l.set(100000, 0)
+	require.Equal(t, minRateBurst, newRateLimiter(1000, 0).chunk())
+	require.Equal(t, 10000, l.chunk())
+}
+
+// testLimitedEchoHandler echoes through the rate limits of its server
+type testLimitedEchoHandler struct {
+	server chan *Server
+}
+
+func (h *testLimitedEchoHandler) Handle(conn *kcp.UDPSession) {
+	defer conn.Close()
+
+	limited := (<-h.server).Limited(conn)
+	io.Copy(limited, limited)
+}
+
+// testTransfer echoes n bytes through client and returns how long it took
+func testTransfer(t *testing.T, client *Client, n int) time.Duration {
+	data := bytes.Repeat([]byte("x"), n)
+	start := time.Now()
+
+	go client.Write(data)
+
+	buf := make([]byte, n)
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err := io.ReadFull(client, buf)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	return time.Since(start)
+}
+
+func TestClient_RateLimit(t *testing.T) {
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithHandler(&testEchoHandler{}))
+	require.NoError(t, err)
+	defer server.Close()
+
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.RateConf = &RateConf{SendRate: 100000, Burst: 10000}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, saddr, WithConfig(conf))
+	require.NoError(t, err)
+	defer client.Close()
+
+	// 10k burst, then 40k at 100k/s
+	d := testTransfer(t, client, 50000)
+	require.True(t, d > 350*time.Millisecond, "took %v", d)
+
+	client.SetRateConf(nil)
+	d = testTransfer(t, client, 50000)
+	require.True(t, d < 300*time.Millisecond, "took %v", d)
+
+	client.SetRateConf(&RateConf{RecvRate: 100000, Burst: 10000})
+	d = testTransfer(t, client, 50000)
+	require.True(t, d > 350*time.Millisecond, "took %v", d)
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.RateConf = &RateConf{GlobalSendRate: 100000, Burst: 10000}
+
+	handler := &testLimitedEchoHandler{server: make(chan *Server, 2)}
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithConfig(conf), WithHandler(handler))
+	require.NoError(t, err)
+	defer server.Close()
+	handler.server <- server
+	handler.server <- server
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, saddr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	other, err := Dial(ctx, saddr)
+	require.NoError(t, err)
+	defer other.Close()
+
+	// both sessions share the global rate
+	start := time.Now()
+	done := make(chan time.Duration)
+	go func() { done <- testTransfer(t, other, 30000) }()
+	testTransfer(t, client, 30000)
+	<-done
+	require.True(t, time.Since(start) > 400*time.Millisecond)
+
+	// limits can be lifted on a running server
+	lifted := DefaultConfig()
+	lifted.Handshake = true
+	require.NoError(t, server.UpdateConfig(lifted, false))
+	d := testTransfer(t, client, 50000)
+	require.True(t, d < 300*time.Millisecond, "took %v", d)
+}
+
+func TestServer_RateLimitMux(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.MuxConf = DefaultMuxConf()
+	conf.RateConf = &RateConf{SendRate: 100000, Burst: 10000}
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithConfig(conf), WithHandler(&testMuxEchoHandler{}))
+	require.NoError(t, err)
+	defer server.Close()
+
+	muxConf := DefaultConfig()
+	muxConf.Handshake = true
+	muxConf.MuxConf = DefaultMuxConf()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, saddr, WithConfig(muxConf))
+	require.NoError(t, err)
+	defer client.Close()
+
+	stream, err := client.OpenStream()
+	require.NoError(t, err)
+	defer stream.Close()
+
+	data := bytes.Repeat([]byte("x"), 50000)
+	start := time.Now()
+	go stream.Write(data)
+
+	buf := make([]byte, len(data))
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) > 350*time.Millisecond)
+}
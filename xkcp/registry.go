@@ -0,0 +1,87 @@
+package xkcp
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// register adds a session that completed its handshake to the registry,
+// s.mu must be held
+func (s *Server) register(conn *kcp.UDPSession) {
+	s.byConv[conn.GetConv()] = append(s.byConv[conn.GetConv()], conn)
+}
+
+// unregister removes a session from the registry, s.mu must be held
+func (s *Server) unregister(conn *kcp.UDPSession) {
+	conv := conn.GetConv()
+	conns := slices.DeleteFunc(s.byConv[conv], func(c *kcp.UDPSession) bool { return c == conn })
+	if len(conns) == 0 {
+		delete(s.byConv, conv)
+	} else {
+		s.byConv[conv] = conns
+	}
+}
+
+// List returns the sessions that completed their handshake and are still
+// handled, sorted by conversation ID and remote address
+func (s *Server) List() []*kcp.UDPSession {
+	s.mu.Lock()
+	var conns []*kcp.UDPSession
+	for _, c := range s.byConv {
+		conns = append(conns, c...)
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(conns, func(a, b *kcp.UDPSession) int {
+		if c := cmp.Compare(a.GetConv(), b.GetConv()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.RemoteAddr().String(), b.RemoteAddr().String())
+	})
+
+	return conns
+}
+
+// Get returns the session of conv. Clients pick their conversation ID at
+// random, but nothing prevents one from reusing the conv of another from its
+// own address: Get then returns the session accepted first.
+func (s *Server) Get(conv uint32) (*kcp.UDPSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if conns := s.byConv[conv]; len(conns) > 0 {
+		return conns[0], true
+	}
+	return nil, false
+}
+
+// CloseSession force-closes the sessions of conv and returns how many there
+// were. They leave the registry once their handler returns, Hooks.OnClose
+// reports them with ClosedForced.
+func (s *Server) CloseSession(conv uint32) int {
+	s.mu.Lock()
+	conns := slices.Clone(s.byConv[conv])
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		s.logger.Info("xkcp: closing session", "remote", conn.RemoteAddr(), "conv", conv)
+		s.closeSession(conn, ClosedForced)
+	}
+
+	return len(conns)
+}
+
+// SessionStats returns the stats of a session in the registry
+func (s *Server) SessionStats(conn *kcp.UDPSession) (SessionStats, bool) {
+	s.mu.Lock()
+	sess, ok := s.sessions[conn]
+	s.mu.Unlock()
+
+	if !ok || !sess.accepted {
+		return SessionStats{}, false
+	}
+
+	return s.metrics.sessionStats(conn)
+}
@@ -0,0 +1,59 @@
+package xkcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Registry(t *testing.T) {
+	hooks := newTestHooks()
+
+	saddr := getTestAddr()
+	server, err := StartServer(saddr, WithHandler(&testEchoHandler{}), WithHooks(hooks))
+	require.NoError(t, err)
+	defer server.Close()
+
+	var clients []*Client
+	for i := 0; i < 2; i++ {
+		client, err := testLimitsDial(t, saddr, 5*time.Second)
+		require.NoError(t, err)
+		testEcho(t, client)
+		hooks.next(t, "accept")
+		clients = append(clients, client)
+	}
+
+	conns := server.List()
+	require.Len(t, conns, 2)
+	require.Less(t, conns[0].GetConv(), conns[1].GetConv())
+
+	kicked, kept := clients[0], clients[1]
+	conn, ok := server.Get(kicked.GetConv())
+	require.True(t, ok)
+	require.Equal(t, kicked.LocalAddr().(*net.UDPAddr).Port, conn.RemoteAddr().(*net.UDPAddr).Port)
+
+	stats, ok := server.SessionStats(conn)
+	require.True(t, ok)
+	require.Equal(t, kicked.GetConv(), stats.Conv)
+	require.Equal(t, RoleServer, stats.Role)
+
+	require.Zero(t, server.CloseSession(kicked.GetConv()^kept.GetConv()))
+	require.Equal(t, 1, server.CloseSession(kicked.GetConv()))
+
+	e := hooks.next(t, "close")
+	require.Equal(t, kicked.GetConv(), e.conv)
+	require.Equal(t, ClosedForced, e.reason)
+
+	// cleaned up along with the session
+	_, ok = server.Get(kicked.GetConv())
+	require.False(t, ok)
+	_, ok = server.SessionStats(conn)
+	require.False(t, ok)
+
+	conns = server.List()
+	require.Len(t, conns, 1)
+	require.Equal(t, kept.GetConv(), conns[0].GetConv())
+	testEcho(t, kept)
+}
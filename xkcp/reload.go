@@ -0,0 +1,200 @@
+package xkcp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"time"
+)
+
+// Config returns the configuration currently used for new sessions
+func (s *Server) Config() *KcpConfig {
+	return s.conf.Load()
+}
+
+// UpdateConfig atomically replaces the configuration used for new sessions.
+// With applyExisting the KCP tuning (mode, windows, MTU, ACK behaviour) is
+// also re-applied to every live session. LimitConf applies from the next
+// accepted session on, sessions already admitted are kept. RateConf applies
+// to every session right away. DSCP, zero clearing it, and SockBuf
+// are applied to the listening socket right away, on a best effort basis for
+// servers created with NewServerWithConn. On other servers a socket option
+// that fails is returned, the options already set are restored and nothing
+// is applied. Seed, Crypt, Key, KDFConf,
+// KeyExchangeConf, AuthConf, CookieConf, PoolConf, KeepAlive, IdleTimeout and
+// FECConf are baked into the listener and cannot change on a running server,
+// such changes are rejected with one *ConfigError per field and nothing is
+// applied.
+//
+// conf must not be modified after it has been handed to UpdateConfig.
+func (s *Server) UpdateConfig(conf *KcpConfig, applyExisting bool) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.conf.Load()
+	if err := checkLiveChange(old, conf); err != nil {
+		return err
+	}
+
+	// like the constructors, only a listener created by NewServer insists on socket options
+	strict := !s.lenient
+
+	// a strict failure puts back the options already applied, so that the
+	// socket keeps matching the configuration in place
+	var undo []func()
+	rollback := func(err error) error {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return err
+	}
+	apply := func(option string, set func(int) error, next, prev int) error {
+		if err := set(next); err != nil {
+			if strict {
+				return err
+			}
+			warnOption(s.logger, option, err)
+			return nil
+		}
+		undo = append(undo, func() { _ = set(prev) })
+		return nil
+	}
+
+	if conf.SockBuf != old.SockBuf {
+		if err := apply("read buffer", s.lis.SetReadBuffer, conf.SockBuf, old.SockBuf); err != nil {
+			return rollback(err)
+		}
+
+		if err := apply("write buffer", s.lis.SetWriteBuffer, conf.SockBuf, old.SockBuf); err != nil {
+			return rollback(err)
+		}
+	}
+
+	if conf.DSCP != old.DSCP {
+		if err := apply("dscp", s.lis.SetDSCP, conf.DSCP, old.DSCP); err != nil {
+			return rollback(err)
+		}
+	}
+
+	s.conf.Store(conf)
+
+	if !reflect.DeepEqual(conf.RateConf, old.RateConf) {
+		s.setRates(conf.RateConf)
+	}
+
+	if applyExisting {
+		for conn := range s.sessions {
+			tuneSession(conn, conf)
+		}
+	}
+
+	s.logger.Info("xkcp: config updated", "addr", s.lis.Addr(), "existing", applyExisting)
+	return nil
+}
+
+// checkLiveChange reports the fields of next that differ from prev but can
+// only be set when the listener is created
+func checkLiveChange(prev, next *KcpConfig) error {
+	var errs []error
+	fixed := func(field string) {
+		errs = append(errs, &ConfigError{Field: field, Reason: "cannot be changed on a running server"})
+	}
+
+	if next.Seed != prev.Seed {
+		fixed("Seed")
+	}
+
+	if next.Crypt != prev.Crypt {
+		fixed("Crypt")
+	}
+
+	if next.Key != prev.Key {
+		fixed("Key")
+	}
+
+	if !reflect.DeepEqual(next.KDFConf, prev.KDFConf) {
+		fixed("KDFConf")
+	}
+
+	if !reflect.DeepEqual(next.KeyExchangeConf, prev.KeyExchangeConf) {
+		fixed("KeyExchangeConf")
+	}
+
+	if !reflect.DeepEqual(next.AuthConf, prev.AuthConf) {
+		fixed("AuthConf")
+	}
+
+	if !reflect.DeepEqual(next.CookieConf, prev.CookieConf) {
+		fixed("CookieConf")
+	}
+
+	if !reflect.DeepEqual(next.PoolConf, prev.PoolConf) {
+		fixed("PoolConf")
+	}
+
+	if next.KeepAlive != prev.KeepAlive {
+		fixed("KeepAlive")
+	}
+
+	if next.IdleTimeout != prev.IdleTimeout {
+		fixed("IdleTimeout")
+	}
+
+	if next.FECConf.DataShard != prev.FECConf.DataShard {
+		fixed("FECConf.DataShard")
+	}
+
+	if next.FECConf.ParityShard != prev.FECConf.ParityShard {
+		fixed("FECConf.ParityShard")
+	}
+
+	return errors.Join(errs...)
+}
+
+// WatchConfig polls the config file at path every interval and applies it
+// with UpdateConfig whenever it changes, see LoadConfig for the file format.
+// Invalid files and rejected changes are logged and the previous
+// configuration stays in place. WatchConfig blocks until ctx is done.
+func (s *Server) WatchConfig(ctx context.Context, path string, interval time.Duration, applyExisting bool) error {
+	last, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			s.logger.Warn("xkcp: watch config failed", "path", path, "err", err)
+			continue
+		}
+
+		if fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+
+		conf, err := LoadConfig(path)
+		if err != nil {
+			s.logger.Error("xkcp: reload config failed", "path", path, "err", err)
+			continue
+		}
+
+		if err := s.UpdateConfig(conf, applyExisting); err != nil {
+			s.logger.Error("xkcp: apply config failed", "path", path, "err", err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package xkcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_UpdateConfig(t *testing.T) {
+	initial := DefaultConfig()
+	initial.Handshake = true
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, initial, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := DialContext(context.Background(), saddr, initial)
+	require.NoError(t, err)
+	defer client.Close()
+
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.ModeConf = GetModeConf(ModeFast3)
+	conf.SndWnd = 2048
+	conf.MTU = 1350
+	conf.AckNodelay = true
+	conf.SockBuf = 4 * 1024 * 1024
+	require.NoError(t, server.UpdateConfig(conf, true))
+	require.Equal(t, conf, server.Config())
+
+	// the live session keeps working with the new tuning
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = client.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// and new sessions are accepted
+	client2, err := DialContext(context.Background(), saddr, initial)
+	require.NoError(t, err)
+	client2.Close()
+}
+
+func TestServer_UpdateConfigRejected(t *testing.T) {
+	server, err := NewServer(getTestAddr(), DefaultConfig(), &testSinkHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	before := server.Config()
+
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.Seed = "other-seed"
+	conf.Crypt = "aes"
+	conf.FECConf = &FECConf{DataShard: 0, ParityShard: 0}
+	conf.KDFConf = &KDFConf{Algorithm: KDFHKDF}
+	conf.AuthConf = &AuthConf{Tokens: map[string]string{"alice": "secret"}}
+	conf.CookieConf = &CookieConf{Always: true}
+	conf.PoolConf = &PoolConf{Workers: 4}
+	conf.KeepAlive = 1000
+	conf.MTU = 1000
+
+	err = server.UpdateConfig(conf, false)
+	require.Error(t, err)
+	require.Equal(t, []string{"Seed", "Crypt", "KDFConf", "AuthConf", "CookieConf", "PoolConf", "KeepAlive", "FECConf.DataShard", "FECConf.ParityShard"},
+		configErrorFields(err))
+	require.Same(t, before, server.Config())
+
+	conf = DefaultConfig()
+	conf.MTU = 0
+	err = server.UpdateConfig(conf, false)
+	var ce *ConfigError
+	require.True(t, errors.As(err, &ce))
+	require.Equal(t, "MTU", ce.Field)
+	require.Same(t, before, server.Config())
+}
+
+func TestServer_WatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kcp.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"mtu": 1200}`), 0o600))
+
+	conf, err := LoadConfig(path)
+	require.NoError(t, err)
+
+	server, err := NewServer(getTestAddr(), conf, &testSinkHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.WatchConfig(ctx, path, 10*time.Millisecond, true) }()
+
+	// a broken file is ignored
+	require.NoError(t, os.WriteFile(path, []byte(`{"mtu": `), 0o600))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1200, server.Config().MTU)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"mtu": 1350, "mode": "fast2"}`), 0o600))
+	require.Eventually(t, func() bool { return server.Config().MTU == 1350 }, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, GetModeConf(ModeFast2), server.Config().ModeConf)
+
+	cancel()
+	require.True(t, errors.Is(<-done, context.Canceled))
+}
+
+// testOptionConn is a socket whose options can be made to refuse changes
+type testOptionConn struct {
+	*net.UDPConn
+
+	failBuffers atomic.Bool
+	failDSCP    atomic.Bool
+	readBuffer  atomic.Int32
+	dscp        atomic.Int32
+}
+
+func (c *testOptionConn) SetReadBuffer(bytes int) error {
+	if c.failBuffers.Load() {
+		return errInvalidOperation
+	}
+	c.readBuffer.Store(int32(bytes))
+	return c.UDPConn.SetReadBuffer(bytes)
+}
+
+func (c *testOptionConn) SetWriteBuffer(bytes int) error {
+	if c.failBuffers.Load() {
+		return errInvalidOperation
+	}
+	return c.UDPConn.SetWriteBuffer(bytes)
+}
+
+func (c *testOptionConn) SetDSCP(dscp int) error {
+	if c.failDSCP.Load() {
+		return errInvalidOperation
+	}
+	c.dscp.Store(int32(dscp))
+	return nil
+}
+
+func TestServer_UpdateConfigSocketOptions(t *testing.T) {
+	udpaddr, err := net.ResolveUDPAddr("udp", getTestAddr())
+	require.NoError(t, err)
+	udpconn, err := net.ListenUDP("udp", udpaddr)
+	require.NoError(t, err)
+	defer udpconn.Close()
+	conn := &testOptionConn{UDPConn: udpconn}
+
+	initial := DefaultConfig()
+	server, err := StartServer("", WithPacketConn(conn), WithConfig(initial), WithHandler(&testSinkHandler{}))
+	require.NoError(t, err)
+	defer server.Close()
+
+	conn.failBuffers.Store(true)
+	conf := DefaultConfig()
+	conf.DSCP = 46
+	conf.SockBuf = initial.SockBuf / 2
+	require.True(t, errors.Is(server.UpdateConfig(conf, false), errInvalidOperation))
+	require.Zero(t, conn.dscp.Load())
+	require.Same(t, initial, server.Config())
+
+	// the buffers already set are restored when the DSCP fails
+	conn.failBuffers.Store(false)
+	conn.failDSCP.Store(true)
+	require.True(t, errors.Is(server.UpdateConfig(conf, false), errInvalidOperation))
+	require.EqualValues(t, initial.SockBuf, conn.readBuffer.Load())
+	require.Same(t, initial, server.Config())
+
+	conn.failDSCP.Store(false)
+	require.NoError(t, server.UpdateConfig(conf, false))
+	require.EqualValues(t, 46, conn.dscp.Load())
+
+	// zero clears the marking
+	conf = DefaultConfig()
+	require.NoError(t, server.UpdateConfig(conf, false))
+	require.Zero(t, conn.dscp.Load())
+}
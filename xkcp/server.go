@@ -1,124 +1,897 @@
 package xkcp
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
 )
 
+// ErrServerClosed is the cause of the contexts of ContextHandler once the
+// Server shuts down, and what Server.Err returns after Close or Shutdown
+var ErrServerClosed = errors.New("xkcp: server closed")
+
+// ErrServerStarted is returned by Serve and SetHooks once Serve was called
+var ErrServerStarted = errors.New("xkcp: server already started")
+
+// ServerConnHandler handles the sessions of a Server. When AuthConf requires
+// authentication, Server.Identity tells who the client of a session is.
+// Handlers may also implement ServerStreamHandler and Authorizer. See
+// ContextHandler for handlers that learn of shutdowns and return errors.
 type ServerConnHandler interface {
 	Handle(conn *kcp.UDPSession)
 }
 
+// ServerStreamHandler is implemented by handlers that accept multiplexed
+// sessions. When both the server and a client set MuxConf, every stream the
+// client opens is passed to HandleStream in its own goroutine.
+type ServerStreamHandler interface {
+	HandleStream(stream net.Conn)
+}
+
 type Server struct {
 	addr    string
-	conf    *KcpConfig
+	conf    atomic.Pointer[KcpConfig] // swapped by UpdateConfig
 	lis     *kcp.Listener
-	handler ServerConnHandler
+	handler ContextHandler
+
+	rawConn   net.PacketConn // socket closed along with lis, if lis does not own it
+	lenient   bool           // socket options are applied on a best effort basis
+	repanic   bool           // see WithRepanic
+	keepalive *keepaliveConn // nil unless trackPeers
+	cookie    *cookieConn    // nil unless CookieConf is set
+	kx        *kxServerConn  // nil unless KeyExchangeConf is set
+	pool      *workerPool    // nil unless PoolConf is set
+
+	auth    *serverAuth // nil when clients need not authenticate
+	logger  *slog.Logger
+	metrics *Metrics
+	hooks   Hooks
+
+	mu          sync.Mutex
+	sessions    map[*kcp.UDPSession]*serverSession
+	byConv      map[uint32][]*kcp.UDPSession // the registry, see List
+	perIP       map[string]int               // live sessions by source IP
+	perAddr     map[string]int               // live sessions by remote address
+	globalRates *sessionRates
+	rate        acceptRate // only used by loop
+	handlers    sync.WaitGroup
+	onShutdown  []func()
+	inShutdown  atomic.Bool
+	started     bool // Serve was called
+
+	baseCtx    context.Context // parent of the session contexts
+	cancelBase context.CancelCauseFunc
+	done       chan struct{} // closed by Close
+	closeOnce  sync.Once
+	err        error // why the listener failed, guarded by mu
+}
 
-	rawConn net.PacketConn
+// serverSession is what a Server keeps of a live session
+type serverSession struct {
+	running     int                // handlers running on the session
+	accepted    bool               // the handshake completed
+	id          *Identity          // nil unless the client authenticated
+	rates       *sessionRates      // nil until Limited is called or the handshake completes
+	closeReason string             // why the server closed the session, if it did
+	cancel      context.CancelFunc // cancels the context of the handler, nil until it runs
+	err         error              // returned by the handler
+	peer        *keepalivePeer     // nil unless the listener tracks peers
 }
 
-// NewServer creates a new xkcp server
+// close closes conn for reason, unless the server already closed it for
+// another one, s.mu must be held
+func (sess *serverSession) close(conn *kcp.UDPSession, reason string) {
+	if sess.closeReason == "" {
+		sess.closeReason = reason
+	}
+	if sess.cancel != nil {
+		sess.cancel()
+	}
+	conn.Close()
+}
+
+// NewServer creates a new xkcp server, socket options in conf that cannot
+// be applied make it fail
 func NewServer(addr string, conf *KcpConfig, handler ServerConnHandler) (*Server, error) {
-	lis, err := kcp.ListenWithOptions(addr, GetBlockCrypt(conf.Seed, conf.Crypt), conf.FECConf.DataShard, conf.FECConf.ParityShard)
+	return StartServer(addr, WithConfig(conf), WithHandler(handler))
+}
+
+// NewServerWithConn creates a new xkcp server on a packet connection, conn is
+// closed with the server. Socket options are applied on a best effort basis.
+func NewServerWithConn(conn net.PacketConn, conf *KcpConfig, handler ServerConnHandler) (*Server, error) {
+	return StartServer("", WithPacketConn(conn), WithConfig(conf), WithHandler(handler), WithBestEffortSocketOptions())
+}
+
+// StartServer creates a new xkcp server listening on addr, or on the
+// connection of WithPacketConn, and starts accepting sessions in the
+// background. See Listen to start the server separately.
+func StartServer(addr string, opts ...Option) (*Server, error) {
+	s, err := Listen(addr, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	if conf.DSCP > 0 {
-		if err := lis.SetDSCP(conf.DSCP); err != nil {
-			lis.Close()
-			return nil, err
-		}
-	}
+	go s.Serve(context.Background())
+
+	return s, nil
+}
 
-	if err := lis.SetReadBuffer(conf.SockBuf); err != nil {
-		lis.Close()
+// Listen creates a new xkcp server listening on addr, or on the connection of
+// WithPacketConn. Sessions are not accepted until Serve is called, clients
+// that dial in the meantime wait for it.
+func Listen(addr string, opts ...Option) (*Server, error) {
+	o := newOptions(opts)
+	logger := o.getLogger()
+
+	l, err := listen(addr, o.conn, o.conf, !o.bestEffort, logger, o.metrics)
+	if err != nil {
 		return nil, err
 	}
 
-	if err := lis.SetWriteBuffer(conf.SockBuf); err != nil {
-		lis.Close()
+	auth, err := newServerAuth(o.conf.AuthConf)
+	if err != nil {
+		if o.conn != nil {
+			l.lis.Close()
+		} else {
+			l.close()
+		}
 		return nil, err
 	}
 
+	if o.conn != nil {
+		addr = o.conn.LocalAddr().String()
+	}
+
 	s := &Server{
-		addr:    addr,
-		conf:    conf,
-		lis:     lis,
-		handler: handler,
+		addr:        addr,
+		lis:         l.lis,
+		handler:     o.handler,
+		rawConn:     l.rawConn,
+		keepalive:   l.keepalive,
+		cookie:      l.cookie,
+		kx:          l.kx,
+		lenient:     o.bestEffort,
+		repanic:     o.repanic,
+		auth:        auth,
+		logger:      logger,
+		metrics:     o.metrics,
+		hooks:       o.getHooks(),
+		sessions:    make(map[*kcp.UDPSession]*serverSession),
+		byConv:      make(map[uint32][]*kcp.UDPSession),
+		perIP:       make(map[string]int),
+		perAddr:     make(map[string]int),
+		globalRates: newGlobalRates(o.conf.RateConf),
+		onShutdown:  o.onShutdown,
+		done:        make(chan struct{}),
+	}
+	s.conf.Store(o.conf)
+	s.baseCtx, s.cancelBase = context.WithCancelCause(context.Background())
+
+	if o.conf.PoolConf != nil {
+		s.pool = newWorkerPool(o.conf.PoolConf)
 	}
 
-	go s.loop()
+	s.logListening()
 
 	return s, nil
 }
 
-// NewServerWithConn
-func NewServerWithConn(conn net.PacketConn, conf *KcpConfig, handler ServerConnHandler) (*Server, error) {
-	lis, err := kcp.ServeConn(GetBlockCrypt(conf.Seed, conf.Crypt), conf.FECConf.DataShard, conf.FECConf.ParityShard, conn)
+// SetHooks replaces the hooks set by WithHooks, nil restores NopHooks. It
+// must be called before Serve, which makes it return ErrServerStarted.
+func (s *Server) SetHooks(h Hooks) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return ErrServerStarted
+	}
+
+	if h == nil {
+		h = NopHooks{}
+	}
+	s.hooks = h
+	return nil
+}
+
+// Serve accepts sessions until the server stops, it returns ErrServerClosed
+// after Close or Shutdown and the error that stopped the listener otherwise,
+// see Err. When ctx is done first the server is closed as with Close and
+// Serve returns ctx.Err(). Serve can only be called once, later calls return
+// ErrServerStarted.
+func (s *Server) Serve(ctx context.Context) error {
+	s.mu.Lock()
+	started := s.started
+	s.started = true
+	s.mu.Unlock()
+
+	if started {
+		return ErrServerStarted
+	}
+	if s.closed() {
+		return s.Err()
+	}
+
+	stop := context.AfterFunc(ctx, s.Close)
+	defer stop()
+
+	conf := s.conf.Load()
+	if s.pool != nil {
+		for i := 0; i < conf.PoolConf.Workers; i++ {
+			go s.worker()
+		}
+	}
+
+	if keepaliveEnabled(conf) {
+		go s.keepaliveLoop()
+	}
+
+	s.loop()
+
+	if err := s.Err(); !errors.Is(err, ErrServerClosed) {
+		return err
+	}
+	if !stop() && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrServerClosed
+}
+
+func (s *Server) logListening() {
+	conf := s.conf.Load()
+	s.logger.Info("xkcp: listening", "addr", s.lis.Addr(), "crypt", conf.Crypt,
+		"mux", conf.MuxConf != nil, "auth", s.auth != nil)
+}
+
+// listening is what listen sets up
+type listening struct {
+	lis       *kcp.Listener
+	rawConn   net.PacketConn // socket to close along with lis, if lis does not own it
+	keepalive *keepaliveConn // nil unless trackPeers
+	cookie    *cookieConn    // nil unless the config enables cookies
+	kx        *kxServerConn  // nil unless the config enables the key exchange
+}
+
+// close closes the listener and its socket
+func (l *listening) close() {
+	l.lis.Close()
+	if l.rawConn != nil {
+		l.rawConn.Close()
+	}
+}
+
+// listen validates conf and creates a kcp listener on conn, or on a new
+// socket bound to addr when conn is nil. With strict, socket options in conf
+// that cannot be applied fail the listener, otherwise they are logged. A conn
+// passed in is returned as the socket to close but is left open on failure.
+// Cookie challenges are counted in metrics.
+func listen(addr string, conn net.PacketConn, conf *KcpConfig, strict bool, logger *slog.Logger, metrics *Metrics) (*listening, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	key, block, err := packetCrypto(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	if conf.DSCP > 0 {
-		_ = lis.SetDSCP(conf.DSCP)
+	opts := func(target socketOptionSetter) error {
+		return setSocketOptions(target, conf, strict, logger)
 	}
 
-	_ = lis.SetReadBuffer(conf.SockBuf)
-	_ = lis.SetWriteBuffer(conf.SockBuf)
+	if conn == nil && !isAEADCrypt(conf.Crypt) && !trackPeers(conf) && conf.CookieConf == nil {
+		// kcp-go owns the socket
+		lis, err := kcp.ListenWithOptions(addr, block, conf.FECConf.DataShard, conf.FECConf.ParityShard)
+		if err != nil {
+			return nil, err
+		}
 
-	s := &Server{
-		addr:    conn.LocalAddr().String(),
-		conf:    conf,
-		lis:     lis,
-		handler: handler,
-		rawConn: conn,
+		if err := opts(lis); err != nil {
+			lis.Close()
+			return nil, err
+		}
+		return &listening{lis: lis}, nil
 	}
 
-	go s.loop()
+	l := &listening{rawConn: conn}
+	if conn == nil {
+		udpaddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
 
-	return s, nil
+		udpconn, err := net.ListenUDP("udp", udpaddr)
+		if err != nil {
+			return nil, err
+		}
+		l.rawConn = udpconn
+	}
+
+	fail := func(err error) (*listening, error) {
+		if conn == nil {
+			l.rawConn.Close()
+		}
+		return nil, err
+	}
+
+	wrapped := l.rawConn
+	if conf.CookieConf != nil {
+		// below the key exchange, which keeps state for new peers too
+		if l.cookie, err = newCookieConn(wrapped, conf.CookieConf, logger, metrics); err != nil {
+			return fail(err)
+		}
+		wrapped = l.cookie
+	}
+
+	if wrapped, err = wrapListenConn(wrapped, conf, key); err != nil {
+		return fail(err)
+	}
+	l.kx, _ = wrapped.(*kxServerConn)
+
+	if trackPeers(conf) {
+		l.keepalive = newKeepaliveConn(wrapped)
+		wrapped = l.keepalive
+	}
+
+	// applied before kcp-go starts reading, a failed listener would
+	// otherwise leave a reader behind on the socket of the caller
+	if err := opts(socketOptions{wrapped}); err != nil {
+		return fail(err)
+	}
+
+	if l.lis, err = kcp.ServeConn(block, conf.FECConf.DataShard, conf.FECConf.ParityShard, wrapped); err != nil {
+		return fail(err)
+	}
+
+	return l, nil
+}
+
+// socketOptionSetter is implemented by kcp.Listener and socketOptions
+type socketOptionSetter interface {
+	SetDSCP(dscp int) error
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
 }
 
-// loop
+// setSocketOptions applies the socket options of conf to target. With strict
+// the first failure is returned, otherwise failures are logged.
+func setSocketOptions(target socketOptionSetter, conf *KcpConfig, strict bool, logger *slog.Logger) error {
+	option := func(name string, err error) error {
+		if err == nil || strict {
+			return err
+		}
+		warnOption(logger, name, err)
+		return nil
+	}
+
+	if conf.DSCP > 0 {
+		if err := option("dscp", target.SetDSCP(conf.DSCP)); err != nil {
+			return err
+		}
+	}
+
+	if err := option("read buffer", target.SetReadBuffer(conf.SockBuf)); err != nil {
+		return err
+	}
+
+	return option("write buffer", target.SetWriteBuffer(conf.SockBuf))
+}
+
+// warnOption logs a socket option that could not be applied, if err is not nil
+func warnOption(logger *slog.Logger, option string, err error) {
+	if err != nil {
+		logger.Warn("xkcp: socket option not applied", "option", option, "err", err)
+	}
+}
+
+// tuneSession applies the KCP tuning in conf to an accepted session
+func tuneSession(conn *kcp.UDPSession, conf *KcpConfig) {
+	conn.SetWriteDelay(false)
+	conn.SetNoDelay(conf.ModeConf.NoDelay, conf.ModeConf.Interval, conf.ModeConf.Resend, conf.ModeConf.NoCongestion)
+	conn.SetMtu(conf.MTU)
+	conn.SetWindowSize(conf.SndWnd, conf.RcvWnd)
+	conn.SetACKNoDelay(conf.AckNodelay)
+}
+
+// loop accepts sessions until the server is closed. kcp-go has no temporary
+// accept errors: it stops reading the socket of a listener after its first
+// error and returns that error to every later accept, so any error stops the
+// server.
 func (s *Server) loop() {
 	for {
 		conn, err := s.lis.AcceptKCP()
 		if err != nil {
-			if errors.Is(err, io.ErrClosedPipe) {
+			if errors.Is(err, io.ErrClosedPipe) || s.closed() {
+				// the socket may fail before the listener reports its closing
 				return
 			}
 
-			log.Printf("%+v\n", err)
+			s.hooks.OnAcceptError(err)
+			s.logger.Error("xkcp: listener failed, stopping", "addr", s.lis.Addr(), "err", err)
+			s.fail(err)
+			return
+		}
+
+		conf := s.conf.Load()
+		if reason := s.admit(conn, conf.LimitConf); reason != "" {
+			s.reject(conn, reason, conf)
+			continue
+		}
+
+		if s.pool != nil && !s.acquireWorker(conn, conf) {
+			continue
+		}
+
+		tuneSession(conn, conf)
+
+		if !s.trackSession(conn) {
+			// shutting down, refuse new sessions
+			s.logger.Debug("xkcp: session refused, shutting down", "remote", conn.RemoteAddr(), "conv", conn.GetConv())
+			conn.Close()
+			s.hooks.OnReject(conn, RejectShutdown, nil)
+			if s.pool != nil {
+				s.releaseWorker()
+			}
 			continue
 		}
 
-		conn.SetWriteDelay(false)
-		conn.SetNoDelay(s.conf.ModeConf.NoDelay, s.conf.ModeConf.Interval, s.conf.ModeConf.Resend, s.conf.ModeConf.NoCongestion)
-		conn.SetMtu(s.conf.MTU)
-		conn.SetWindowSize(s.conf.SndWnd, s.conf.RcvWnd)
-		conn.SetACKNoDelay(s.conf.AckNodelay)
+		s.logger.Debug("xkcp: session accepted", "remote", conn.RemoteAddr(), "conv", conn.GetConv())
 
-		go s.handleConn(conn)
+		s.dispatch(conn)
 	}
 }
 
 func (s *Server) handleConn(conn *kcp.UDPSession) {
-	if s.handler != nil {
-		s.handler.Handle(conn)
+	defer s.untrackSession(conn)
+
+	release := sync.OnceFunc(func() { s.releaseSession(conn) })
+	defer release()
+	defer s.recoverHandler(conn)
+
+	conf := s.conf.Load()
+	supported := byte(flagAckRequested)
+	impl := handlerImpl(s.handler)
+	streamHandler, ok := impl.(ServerStreamHandler)
+	if ok && conf.MuxConf != nil {
+		supported |= flagMux
+	}
+
+	var authorize func(*Identity) error
+	if a, ok := impl.(Authorizer); ok {
+		authorize = func(id *Identity) error { return a.Authorize(conn.RemoteAddr(), id) }
+	}
+
+	requested, id, err := serverHandshake(conn, conf.Handshake, supported, s.auth, authorize)
+	if err != nil {
+		s.logger.Warn("xkcp: handshake failed", "remote", conn.RemoteAddr(), "conv", conn.GetConv(), "err", err)
+		s.metrics.handshakeFailures.Add(1)
+		conn.Close()
+		s.hooks.OnReject(conn, RejectHandshake, err)
+		return
 	}
+
+	s.logger.Debug("xkcp: handshake completed", "remote", conn.RemoteAddr(), "conv", conn.GetConv(),
+		"mux", requested&flagMux != 0, "identity", id.String())
+
+	s.metrics.accepted.Add(1)
+
+	s.mu.Lock()
+	s.sessions[conn].accepted = true
+	s.sessions[conn].id = id
+	s.register(conn)
+	rates := s.sessionRates(conn)
+	s.mu.Unlock()
+
+	s.metrics.addSession(conn, RoleServer, id, rates)
+
+	s.hooks.OnAccept(conn, id)
+
+	if requested&flagMux != 0 && supported&flagMux == 0 {
+		// the client will only speak smux from now on
+		s.logger.Warn("xkcp: mux requested but not served", "remote", conn.RemoteAddr(), "conv", conn.GetConv())
+		s.closeSession(conn, ClosedByServer)
+		return
+	}
+
+	if s.inShutdown.Load() {
+		s.closeSession(conn, ClosedByServer)
+		return
+	}
+
+	if requested&flagMux != 0 {
+		// the session stays registered while it is idle so that Close
+		// reaches it, but only running stream handlers hold up Shutdown
+		release()
+		s.serveMux(conn, id, streamHandler, conf.MuxConf)
+		return
+	}
+
+	if s.handler == nil {
+		return
+	}
+
+	err = s.handler.ServeConn(s.sessionContext(conn), newConn(s, conn, id))
+
+	s.mu.Lock()
+	s.sessions[conn].err = err
+	s.mu.Unlock()
+}
+
+// sessionContext returns the context of the handler of a tracked session
+func (s *Server) sessionContext(conn *kcp.UDPSession) context.Context {
+	ctx, cancel := context.WithCancel(s.baseCtx)
+
+	s.mu.Lock()
+	sess := s.sessions[conn]
+	sess.cancel = cancel
+	if sess.closeReason != "" {
+		cancel()
+	}
+	s.mu.Unlock()
+
+	return ctx
+}
+
+// serveMux accepts the streams of a multiplexed session until it is closed,
+// the streams of an authenticated session carry its identity
+func (s *Server) serveMux(conn *kcp.UDPSession, id *Identity, handler ServerStreamHandler, muxConf *MuxConf) {
+	sess, err := smux.Server(s.Limited(conn), muxConf.smuxConfig())
+	if err != nil {
+		s.logger.Error("xkcp: mux failed", "remote", conn.RemoteAddr(), "conv", conn.GetConv(), "err", err)
+		conn.Close()
+		return
+	}
+
+	var streams sync.WaitGroup
+	defer streams.Wait()
+
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			sess.Close()
+			return
+		}
+
+		if !s.acquireSession(conn) {
+			stream.Close()
+			continue
+		}
+
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			defer s.releaseSession(conn)
+			defer s.recoverHandler(conn)
+			handler.HandleStream(withIdentity(stream, id))
+		}()
+	}
+}
+
+// keepaliveLoop probes quiet sessions and closes idle ones until the server
+// is closed, it keeps running while Shutdown drains the sessions
+func (s *Server) keepaliveLoop() {
+	conf := s.conf.Load()
+	keepalive := time.Duration(conf.KeepAlive) * time.Millisecond
+	idle := time.Duration(conf.IdleTimeout) * time.Millisecond
+
+	ticker := time.NewTicker(keepaliveTick(conf))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		peers := make(map[*kcp.UDPSession]*keepalivePeer, len(s.sessions))
+		for conn, sess := range s.sessions {
+			peers[conn] = sess.peer
+		}
+		s.mu.Unlock()
+
+		for conn, peer := range peers {
+			if s.keepalive.check(conn.RemoteAddr(), peer, keepalive, idle) {
+				s.logger.Info("xkcp: session idle, closing", "remote", conn.RemoteAddr(), "conv", conn.GetConv(), "err", ErrIdleTimeout)
+				s.metrics.idleTimeouts.Add(1)
+				// the session is untracked once its handler returns
+				s.keepalive.untrack(conn.RemoteAddr(), peer)
+				s.closeSession(conn, ClosedIdle)
+			}
+		}
+	}
+}
+
+// trackSession registers a session handed out by loop with one running
+// handler, it reports false once the server is shutting down.
+func (s *Server) trackSession(conn *kcp.UDPSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inShutdown.Load() {
+		return false
+	}
+
+	sess := &serverSession{running: 1}
+	s.sessions[conn] = sess
+	s.perIP[addrIP(conn.RemoteAddr())]++
+	s.perAddr[conn.RemoteAddr().String()]++
+	s.handlers.Add(1)
+
+	if s.keepalive != nil {
+		sess.peer = s.keepalive.track(conn.RemoteAddr())
+	}
+	return true
+}
+
+// untrackSession forgets a session once its last handler has returned
+func (s *Server) untrackSession(conn *kcp.UDPSession) {
+	s.mu.Lock()
+	sess := s.sessions[conn]
+	delete(s.sessions, conn)
+	if sess.accepted {
+		s.unregister(conn)
+	}
+	if ip := addrIP(conn.RemoteAddr()); s.perIP[ip] > 1 {
+		s.perIP[ip]--
+	} else {
+		delete(s.perIP, ip)
+	}
+	// kcp-go replaces the session of an address when a new conversation
+	// starts from it, the address is then still in use
+	addr := conn.RemoteAddr().String()
+	reused := s.perAddr[addr] > 1
+	if reused {
+		s.perAddr[addr]--
+	} else {
+		delete(s.perAddr, addr)
+	}
+	s.mu.Unlock()
+
+	if sess.cancel != nil {
+		sess.cancel()
+	}
+
+	if sess.accepted {
+		reason := sess.closeReason
+		if reason == "" {
+			reason = ClosedByHandler
+		}
+
+		if reason == ClosedByHandler && sess.err != nil {
+			s.logger.Warn("xkcp: handler failed", "remote", conn.RemoteAddr(), "conv", conn.GetConv(), "err", sess.err)
+		}
+
+		stats, _ := s.metrics.sessionStats(conn)
+		s.hooks.OnClose(conn, reason, sess.err, stats)
+	}
+
+	s.metrics.removeSession(conn)
+	if s.keepalive != nil {
+		s.keepalive.untrack(conn.RemoteAddr(), sess.peer)
+	}
+	if s.cookie != nil && !reused {
+		s.cookie.forget(conn.RemoteAddr())
+	}
+	if s.kx != nil && !reused {
+		s.kx.forget(conn.RemoteAddr())
+	}
+	s.logger.Debug("xkcp: session closed", "remote", conn.RemoteAddr(), "conv", conn.GetConv())
+}
+
+// Identity returns who the client of a session authenticated as, nil when
+// AuthConf does not require authentication
+func (s *Server) Identity(conn *kcp.UDPSession) *Identity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[conn]; ok {
+		return sess.id
+	}
+	return nil
+}
+
+// Stats returns the stats of the sessions that completed their handshake
+func (s *Server) Stats() []SessionStats {
+	s.mu.Lock()
+	conns := make([]*kcp.UDPSession, 0, len(s.sessions))
+	for conn := range s.sessions {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	stats := make([]SessionStats, 0, len(conns))
+	for _, conn := range conns {
+		if st, ok := s.metrics.sessionStats(conn); ok {
+			stats = append(stats, st)
+		}
+	}
+
+	return stats
+}
+
+// acquireSession accounts for one more running handler on a tracked session,
+// it reports false once the server is shutting down.
+func (s *Server) acquireSession(conn *kcp.UDPSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inShutdown.Load() {
+		return false
+	}
+
+	s.sessions[conn].running++
+	s.handlers.Add(1)
+	return true
+}
+
+// releaseSession accounts for a returned handler on a tracked session
+func (s *Server) releaseSession(conn *kcp.UDPSession) {
+	s.mu.Lock()
+	s.sessions[conn].running--
+	s.mu.Unlock()
+
+	s.handlers.Done()
 }
 
-// Close closes the server
+// closeSessions force-closes every tracked session and returns how many of
+// them still had a running handler
+func (s *Server) closeSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	busy := 0
+	for conn, sess := range s.sessions {
+		if sess.running > 0 {
+			busy++
+		}
+		sess.close(conn, ClosedByServer)
+	}
+
+	return busy
+}
+
+// closeSession closes a tracked session for reason, unless the server already
+// closed it for another one
+func (s *Server) closeSession(conn *kcp.UDPSession, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[conn]; ok {
+		sess.close(conn, reason)
+	} else {
+		conn.Close()
+	}
+}
+
+// closeReason returns why the server closed a tracked session, or an empty
+// string
+func (s *Server) closeReason(conn *kcp.UDPSession) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[conn]; ok {
+		return sess.closeReason
+	}
+	return ""
+}
+
+// RegisterOnShutdown registers a function to call when Shutdown starts, it is
+// how handlers learn that they should finish their sessions.
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.mu.Lock()
+	s.onShutdown = append(s.onShutdown, f)
+	s.mu.Unlock()
+}
+
+// Shutdown gracefully shuts down the server: it stops accepting new sessions,
+// runs the functions registered with RegisterOnShutdown and waits for the
+// running handlers to return. If ctx is done first the remaining sessions are
+// force-closed, Shutdown then returns how many were dropped along with ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	s.inShutdown.Store(true)
+	onShutdown := s.onShutdown
+	s.mu.Unlock()
+
+	s.cancelBase(ErrServerClosed)
+
+	s.logger.Info("xkcp: shutting down", "addr", s.lis.Addr())
+
+	for _, f := range onShutdown {
+		go f()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(drained)
+	}()
+
+	var dropped int
+	var err error
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		dropped = s.closeSessions()
+		err = ctx.Err()
+		s.logger.Warn("xkcp: shutdown timed out", "addr", s.lis.Addr(), "dropped", dropped, "err", err)
+	}
+
+	s.Close()
+	return dropped, err
+}
+
+// fail stops the server after its listener failed with err
+func (s *Server) fail(err error) {
+	s.mu.Lock()
+	s.err = fmt.Errorf("xkcp: listener failed: %w", err)
+	s.mu.Unlock()
+
+	s.Close()
+}
+
+// closed reports whether Close has been called
+func (s *Server) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a channel that is closed once the server stopped, after Close,
+// Shutdown or a failure of its listener. Err then tells why.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns nil while Done is not closed. Afterwards it returns the error
+// that stopped the listener, which wraps the error of the socket, or
+// ErrServerClosed.
+func (s *Server) Err() error {
+	if !s.closed() {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	return ErrServerClosed
+}
+
+// Close closes the server immediately, including every session whose handler
+// is still running. Use Shutdown to let them finish first.
 func (s *Server) Close() {
+	s.mu.Lock()
+	s.inShutdown.Store(true)
+	s.mu.Unlock()
+
+	s.closeOnce.Do(func() { close(s.done) })
+	s.cancelBase(ErrServerClosed)
+
+	// before the listener, whose sessions fail along with it
+	s.closeSessions()
+
 	s.lis.Close()
 
 	if s.rawConn != nil {
 		s.rawConn.Close()
 	}
+
+	s.logger.Info("xkcp: server closed", "addr", s.lis.Addr())
 }
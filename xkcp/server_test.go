@@ -1,8 +1,14 @@
 package xkcp
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -19,6 +25,18 @@ func getTestAddr() string {
 	return fmt.Sprintf("127.0.0.1:%v", port)
 }
 
+// testEcho checks that conn gets its data echoed
+func testEcho(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
 type testSinkHandler struct{}
 
 func (h *testSinkHandler) Handle(conn *kcp.UDPSession) {
@@ -542,4 +560,533 @@ func BenchmarkSinkWithLossyConn_Comparison_Seed(b *testing.B) {
 			b.Run("No-Limit", perfSinkLossyConnBenchmarkRunner(1048576, 0.3, 100))
 		})
 	})
-}
\ No newline at end of file
+}
+
+// testBlockingHandler holds every session until release is closed
+type testBlockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newTestBlockingHandler() *testBlockingHandler {
+	return &testBlockingHandler{started: make(chan struct{}, 16), release: make(chan struct{})}
+}
+
+func (h *testBlockingHandler) Handle(conn *kcp.UDPSession) {
+	defer conn.Close()
+
+	h.started <- struct{}{}
+	<-h.release
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	saddr := getTestAddr()
+	handler := newTestBlockingHandler()
+	server, err := NewServer(saddr, conf, handler)
+	require.NoError(t, err)
+
+	var once sync.Once
+	server.RegisterOnShutdown(func() { once.Do(func() { close(handler.release) }) })
+
+	client, err := DialContext(context.Background(), saddr, conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	<-handler.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dropped, err := server.Shutdown(ctx)
+	require.NoError(t, err)
+	require.Zero(t, dropped)
+}
+
+func TestServer_Shutdown_ForceClose(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testSinkHandler{})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		client, err := DialContext(context.Background(), saddr, conf)
+		require.NoError(t, err)
+		defer client.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// the sink handler never returns on its own, both sessions get dropped
+	dropped, err := server.Shutdown(ctx)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Equal(t, 2, dropped)
+}
+
+func TestServer_Shutdown_RefusesNewSessions(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	saddr := getTestAddr()
+	handler := newTestBlockingHandler()
+	server, err := NewServer(saddr, conf, handler)
+	require.NoError(t, err)
+	defer close(handler.release)
+
+	client, err := DialContext(context.Background(), saddr, conf)
+	require.NoError(t, err)
+	defer client.Close()
+	<-handler.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	go server.Shutdown(ctx)
+	time.Sleep(50 * time.Millisecond)
+
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer dialCancel()
+
+	_, err = DialContext(dialCtx, saddr, conf)
+	require.Error(t, err)
+}
+
+// testMuxEchoHandler echoes plain sessions and multiplexed streams
+type testMuxEchoHandler struct {
+	testEchoHandler
+}
+
+func (h *testMuxEchoHandler) HandleStream(stream net.Conn) {
+	defer stream.Close()
+
+	io.Copy(stream, stream)
+}
+
+func TestServer_PlainKCPClient(t *testing.T) {
+	conf := DefaultConfig()
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	// a kcp-go peer that knows nothing of the preamble
+	block, err := GetBlockCrypt(conf.Seed, conf.Crypt)
+	require.NoError(t, err)
+	client, err := kcp.DialWithOptions(saddr, block, conf.FECConf.DataShard, conf.FECConf.ParityShard)
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+}
+
+func TestServer_Mux(t *testing.T) {
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.MuxConf = DefaultMuxConf()
+	server, err := NewServer(saddr, conf, &testMuxEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := DialContext(context.Background(), saddr, conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		stream, err := client.OpenStream()
+		require.NoError(t, err)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer stream.Close()
+
+			msg := []byte(fmt.Sprintf("stream-%d", i))
+			_, err := stream.Write(msg)
+			require.NoError(t, err)
+
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(stream, buf)
+			require.NoError(t, err)
+			require.Equal(t, msg, buf)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestServer_MuxPlainClient(t *testing.T) {
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.MuxConf = DefaultMuxConf()
+	server, err := NewServer(saddr, conf, &testMuxEchoHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	// a client without mux still gets the whole session
+	plain := DefaultConfig()
+	plain.Handshake = true
+	client, err := DialContext(context.Background(), saddr, plain)
+	require.NoError(t, err)
+	defer client.Close()
+
+	testEcho(t, client)
+}
+
+func TestServer_MuxRejected(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Handshake = true
+
+	saddr := getTestAddr()
+	server, err := NewServer(saddr, conf, &testSinkHandler{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	conf = DefaultConfig()
+	conf.Handshake = true
+	conf.MuxConf = DefaultMuxConf()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = DialContext(ctx, saddr, conf)
+	require.True(t, errors.Is(err, ErrMuxRejected), "unexpected error: %v", err)
+}
+
+func TestServer_MuxShutdown(t *testing.T) {
+	saddr := getTestAddr()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.MuxConf = DefaultMuxConf()
+	server, err := NewServer(saddr, conf, &testMuxEchoHandler{})
+	require.NoError(t, err)
+
+	client, err := DialContext(context.Background(), saddr, conf)
+	require.NoError(t, err)
+	defer client.Close()
+
+	stream, err := client.OpenStream()
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("x"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(stream, make([]byte, 1))
+	require.NoError(t, err)
+	stream.Close()
+
+	// an idle multiplexed session does not hold up the drain
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dropped, err := server.Shutdown(ctx)
+	require.NoError(t, err)
+	require.Zero(t, dropped)
+}
+
+func TestNewServer_InvalidConfig(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Crypt = "rot13"
+
+	server, err := NewServer(getTestAddr(), conf, &testSinkHandler{})
+	var ce *ConfigError
+	require.True(t, errors.As(err, &ce))
+	require.Equal(t, "Crypt", ce.Field)
+	require.Nil(t, server)
+
+	conn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conf = DefaultConfig()
+	conf.ModeConf = nil
+	server, err = NewServerWithConn(conn, conf, &testSinkHandler{})
+	require.Error(t, err)
+	require.Nil(t, server)
+}
+
+// floodConn is a server socket that also receives datagrams from spoofed
+// sources in 10.0.0.0/8, the way a spoofed flood looks from the server.
+// Replies to spoofed sources are counted and dropped.
+type floodConn struct {
+	net.PacketConn
+	packets chan floodPacket
+	replies atomic.Int64
+}
+
+type floodPacket struct {
+	data []byte
+	addr net.Addr
+	err  error
+}
+
+func newFloodConn(t *testing.T) *floodConn {
+	conn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+
+	c := &floodConn{PacketConn: conn, packets: make(chan floodPacket, 4096)}
+	go func() {
+		for {
+			buf := make([]byte, 2048)
+			n, addr, err := conn.ReadFrom(buf)
+			c.packets <- floodPacket{data: buf[:n], addr: addr, err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+func (c *floodConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	pkt := <-c.packets
+	if pkt.err != nil {
+		// keep failing the next reads too
+		c.packets <- pkt
+		return 0, nil, pkt.err
+	}
+
+	return copy(p, pkt.data), pkt.addr, nil
+}
+
+func (c *floodConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if udp, ok := addr.(*net.UDPAddr); ok && udp.IP[len(udp.IP)-4] == 10 {
+		c.replies.Add(1)
+		return len(p), nil
+	}
+
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// flood delivers n KCP datagrams, each opening a new conversation from a
+// new spoofed source, the first one from the source numbered first
+func (c *floodConn) flood(first, n int) {
+	for i := first; i < first+n; i++ {
+		pkt := make([]byte, kcpMinPacket)
+		binary.LittleEndian.PutUint32(pkt, uint32(i+1)) // conv
+		pkt[4] = 81                                     // IKCP_CMD_PUSH
+
+		addr := &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 40000}
+		c.packets <- floodPacket{data: pkt, addr: addr}
+	}
+}
+
+func testSessionCount(s *Server) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+func TestServer_SpoofedFlood(t *testing.T) {
+	// let spoofed datagrams through the kcp-go checksums
+	conf := DefaultConfig()
+	conf.Crypt, conf.Seed = "null", ""
+	conf.FECConf = &FECConf{}
+
+	conn := newFloodConn(t)
+	server, err := StartServer("", WithPacketConn(conn), WithConfig(conf), WithBestEffortSocketOptions(),
+		WithHandler(&testEchoHandler{}), WithMetrics(NewMetrics()))
+	require.NoError(t, err)
+	defer server.Close()
+
+	// every spoofed source holds a session until its handshake times out
+	conn.flood(0, 100)
+	require.Eventually(t, func() bool { return testSessionCount(server) == 100 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_SpoofedFloodCookies(t *testing.T) {
+	h := &testLogHandler{level: slog.LevelDebug}
+	metrics := NewMetrics()
+	conf := DefaultConfig()
+	conf.Handshake = true
+	conf.Crypt, conf.Seed = "null", ""
+	conf.FECConf = &FECConf{}
+	conf.CookieConf = &CookieConf{Threshold: 20}
+
+	conn := newFloodConn(t)
+	server, err := StartServer("", WithPacketConn(conn), WithConfig(conf), WithBestEffortSocketOptions(),
+		WithHandler(&testEchoHandler{}), WithMetrics(metrics), WithLogger(slog.New(h)))
+	require.NoError(t, err)
+	defer server.Close()
+
+	// keep the server under load
+	stop := make(chan struct{})
+	flooded := make(chan struct{})
+	go func() {
+		defer close(flooded)
+		for i := 0; ; i += 100 {
+			conn.flood(i, 100)
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	h.eventually(t, "xkcp: under load, requiring cookies")
+	require.Eventually(t, func() bool { return conn.replies.Load() >= 1000 }, 2*time.Second, 10*time.Millisecond)
+	require.LessOrEqual(t, testSessionCount(server), conf.CookieConf.Threshold)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, conn.LocalAddr().String(), WithConfig(conf), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer client.Close()
+	testEcho(t, client)
+
+	// a client without cookies cannot get in
+	plain := *conf
+	plain.CookieConf = nil
+
+	plainCtx, plainCancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer plainCancel()
+
+	_, err = Dial(plainCtx, conn.LocalAddr().String(), WithConfig(&plain), WithMetrics(metrics))
+	require.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+
+	close(stop)
+	<-flooded
+	require.NotZero(t, metrics.Snapshot().CookieChallenges)
+	require.LessOrEqual(t, testSessionCount(server), conf.CookieConf.Threshold+1)
+
+	// once the flood is over, new peers get in right away
+	time.Sleep(1100 * time.Millisecond)
+
+	client, err = Dial(ctx, conn.LocalAddr().String(), WithConfig(&plain), WithMetrics(metrics))
+	require.NoError(t, err)
+	defer client.Close()
+	testEcho(t, client)
+	h.eventually(t, "xkcp: load over, cookies no longer required")
+}
+
+func TestServer_ListenerFailed(t *testing.T) {
+	conn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+
+	server, err := StartServer("", WithPacketConn(plainPacketConn{conn}), WithHandler(&testEchoHandler{}),
+		WithBestEffortSocketOptions())
+	require.NoError(t, err)
+	defer server.Close()
+	require.NoError(t, server.Err())
+
+	// the socket is closed behind the back of the server
+	conn.Close()
+
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still running")
+	}
+	require.True(t, errors.Is(server.Err(), net.ErrClosed), "unexpected error: %v", server.Err())
+}
+
+func TestServer_DoneAfterClose(t *testing.T) {
+	server, err := StartServer(getTestAddr(), WithHandler(&testEchoHandler{}))
+	require.NoError(t, err)
+
+	select {
+	case <-server.Done():
+		t.Fatal("server stopped")
+	default:
+	}
+
+	server.Close()
+	<-server.Done()
+	require.Equal(t, ErrServerClosed, server.Err())
+}
+
+// testServe runs server.Serve(ctx) in the background
+func testServe(ctx context.Context, server *Server) <-chan error {
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx) }()
+	return served
+}
+
+// testServed returns the error Serve returned
+func testServed(t *testing.T, served <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-served:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+		return nil
+	}
+}
+
+func TestServer_ListenServe(t *testing.T) {
+	hooks := newTestHooks()
+
+	saddr := getTestAddr()
+	server, err := Listen(saddr, WithHandler(&testEchoHandler{}))
+	require.NoError(t, err)
+	defer server.Close()
+	require.NoError(t, server.SetHooks(hooks))
+
+	// the session waits for Serve
+	dialed := testPoolDial(t, saddr)
+	select {
+	case err := <-dialed:
+		t.Fatalf("session handled before Serve: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	served := testServe(context.Background(), server)
+	require.NoError(t, <-dialed)
+	hooks.next(t, "accept")
+
+	require.Equal(t, ErrServerStarted, server.Serve(context.Background()))
+	require.Equal(t, ErrServerStarted, server.SetHooks(nil))
+
+	server.Close()
+	require.Equal(t, ErrServerClosed, testServed(t, served))
+	hooks.next(t, "close")
+}
+
+func TestServer_ServeContext(t *testing.T) {
+	server, err := Listen(getTestAddr(), WithHandler(&testEchoHandler{}))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := testServe(ctx, server)
+
+	cancel()
+	require.Equal(t, context.Canceled, testServed(t, served))
+	<-server.Done()
+	require.Equal(t, ErrServerClosed, server.Err())
+}
+
+func TestServer_ServeListenerFailed(t *testing.T) {
+	conn, err := net.ListenPacket("udp", getTestAddr())
+	require.NoError(t, err)
+
+	server, err := Listen("", WithPacketConn(plainPacketConn{conn}), WithHandler(&testEchoHandler{}),
+		WithBestEffortSocketOptions())
+	require.NoError(t, err)
+	defer server.Close()
+
+	served := testServe(context.Background(), server)
+	conn.Close()
+
+	err = testServed(t, served)
+	require.True(t, errors.Is(err, net.ErrClosed), "unexpected error: %v", err)
+	require.Equal(t, server.Err(), err)
+}
+
+func TestServer_CloseBeforeServe(t *testing.T) {
+	server, err := Listen(getTestAddr(), WithHandler(&testEchoHandler{}))
+	require.NoError(t, err)
+
+	server.Close()
+	<-server.Done()
+	require.Equal(t, ErrServerClosed, server.Serve(context.Background()))
+}